@@ -0,0 +1,31 @@
+// Command recount recomputes the denormalized like and comment counters on
+// posts. The server keeps them in step transactionally; run this after
+// manual data fixes or if the counters are ever suspected to have drifted.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"aitu-connect/internal/db"
+	"aitu-connect/internal/repo"
+)
+
+func main() {
+	if os.Getenv("DATABASE_URL") == "" {
+		log.Fatal("DATABASE_URL is required")
+	}
+
+	pool, err := db.NewPool()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+
+	fixed, err := repo.NewPostRepo(pool).RecountCounters(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Recounted post counters, %d posts had drifted", fixed)
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"aitu-connect/internal/broker"
 	"aitu-connect/internal/db"
 	"aitu-connect/internal/handlers"
 	"aitu-connect/internal/middleware"
 	"aitu-connect/internal/repo"
 	"aitu-connect/internal/services"
+	"aitu-connect/internal/storage"
 )
 
 func main() {
@@ -29,15 +34,82 @@ func main() {
 	sessRepo := repo.NewSessionRepo(pool)
 	postRepo := repo.NewPostRepo(pool)
 	chatRepo := repo.NewChatRepo(pool)
+	attachmentRepo := repo.NewAttachmentRepo(pool)
+	followRepo := repo.NewFollowRepo(pool)
+	presenceRepo := repo.NewPresenceRepo(pool)
+
+	// Attachment storage
+	var store storage.Storage
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		store, err = storage.NewLocalStorage(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "s3":
+		store = storage.NewS3Storage(storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+	default:
+		log.Fatal("STORAGE_BACKEND must be local or s3")
+	}
 
 	// Services
 	authSvc := services.NewAuthService(userRepo, sessRepo)
+	imageWorker := services.NewImageWorker(attachmentRepo, store)
+
+	// Popular feed ranking
+	rankerCfg := services.DefaultRankerConfig
+	rankerCfg.LikeWeight = envFloat("FEED_LIKE_WEIGHT", rankerCfg.LikeWeight)
+	rankerCfg.CommentWeight = envFloat("FEED_COMMENT_WEIGHT", rankerCfg.CommentWeight)
+	rankerCfg.HalfLife = envDuration("FEED_HALF_LIFE", rankerCfg.HalfLife)
+	rankerCfg.Interval = envDuration("FEED_SCORE_INTERVAL", rankerCfg.Interval)
+	feedRanker := services.NewFeedRanker(postRepo, rankerCfg)
+
+	// Background workers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go imageWorker.Run(ctx)
+	go feedRanker.Run(ctx)
+
+	// Chat fan-out. Use the postgres broker when running more than one instance.
+	var chatBroker broker.Broker
+	switch os.Getenv("CHAT_BROKER") {
+	case "", "memory":
+		chatBroker = broker.NewMemoryBroker()
+	case "postgres":
+		chatBroker = broker.NewPostgresBroker(pool)
+	default:
+		log.Fatal("CHAT_BROKER must be memory or postgres")
+	}
+	defer chatBroker.Close()
+	chatSvc := services.NewChatService(chatRepo, userRepo, chatBroker)
+
+	// How deep comment replies may nest
+	maxCommentDepth := handlers.DefaultMaxCommentDepth
+	if v := os.Getenv("COMMENT_MAX_DEPTH"); v != "" {
+		maxCommentDepth, err = strconv.Atoi(v)
+		if err != nil || maxCommentDepth < 0 {
+			log.Fatal("COMMENT_MAX_DEPTH must be a non-negative integer")
+		}
+	}
 
 	// Handlers
 	authH := handlers.NewAuthHandler(authSvc)
-	profileH := handlers.NewProfileHandler(userRepo)
-	postH := handlers.NewPostHandler(postRepo)
-	chatH := handlers.NewChatHandler(chatRepo, userRepo)
+	profileH := handlers.NewProfileHandler(userRepo, followRepo, authSvc)
+	postH := handlers.NewPostHandler(postRepo, userRepo, chatSvc, maxCommentDepth)
+	tagH := handlers.NewTagHandler(postRepo)
+	chatH := handlers.NewChatHandler(chatSvc, chatRepo, userRepo, attachmentRepo, presenceRepo)
+	attachmentH := handlers.NewAttachmentHandler(attachmentRepo, store, imageWorker)
+	go chatH.RunPresence(ctx)
 
 	mux := http.NewServeMux()
 
@@ -48,20 +120,57 @@ func main() {
 
 	// Profile API
 	mux.Handle("GET /api/me", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.Me)))
+	mux.Handle("PUT /api/me/username", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.SetUsername)))
+	mux.Handle("GET /api/usernames/{username}", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.GetProfileByUsername)))
+	mux.Handle("GET /api/users/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.GetProfile)))
+	mux.Handle("POST /api/users/{id}/follow", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.Follow)))
+	mux.Handle("DELETE /api/users/{id}/follow", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.Unfollow)))
+	mux.Handle("GET /api/users/{id}/followers", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.GetFollowers)))
+	mux.Handle("GET /api/users/{id}/following", middleware.RequireAuth(sessRepo, http.HandlerFunc(profileH.GetFollowing)))
 
 	// Posts API
 	mux.Handle("GET /api/posts/feed", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.GetFeed)))
 	mux.Handle("POST /api/posts", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.CreatePost)))
+	mux.Handle("PATCH /api/posts/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.UpdatePost)))
+	mux.Handle("DELETE /api/posts/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.DeletePost)))
+	mux.Handle("POST /api/posts/{id}/restore", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.RestorePost)))
+	mux.Handle("GET /api/posts/{id}/revisions", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.GetRevisions)))
 	mux.Handle("POST /api/posts/like", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.ToggleLike)))
 	mux.Handle("POST /api/posts/comment", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.AddComment)))
 	mux.Handle("GET /api/posts/comments", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.GetComments)))
+	mux.Handle("PATCH /api/posts/comments/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.UpdateComment)))
+	mux.Handle("DELETE /api/posts/comments/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.DeleteComment)))
+	mux.Handle("POST /api/posts/comments/{id}/like", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.ToggleCommentLike)))
+	mux.Handle("GET /api/posts/comments/{id}/replies", middleware.RequireAuth(sessRepo, http.HandlerFunc(postH.GetReplies)))
+
+	// Tags API
+	mux.Handle("GET /api/tags/trending", middleware.RequireAuth(sessRepo, http.HandlerFunc(tagH.GetTrending)))
+	mux.Handle("GET /api/tags/{tag}/posts", middleware.RequireAuth(sessRepo, http.HandlerFunc(tagH.GetTagPosts)))
 
 	// Chat API
 	mux.Handle("GET /api/chat/conversations", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetConversations)))
+	mux.Handle("PATCH /api/chat/conversations/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.UpdateConversationSettings)))
 	mux.Handle("GET /api/chat/conversation", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetOrCreateConversation)))
 	mux.Handle("GET /api/chat/messages", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetMessages)))
+	mux.Handle("POST /api/chat/messages", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.SendMessage)))
+	mux.Handle("PATCH /api/chat/messages/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.EditMessage)))
+	mux.Handle("DELETE /api/chat/messages/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.DeleteMessage)))
+	mux.Handle("GET /api/chat/messages/{id}/history", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetMessageHistory)))
+	mux.Handle("POST /api/chat/messages/{id}/reactions", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.AddReaction)))
+	mux.Handle("DELETE /api/chat/messages/{id}/reactions", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.RemoveReaction)))
+	mux.Handle("GET /api/chat/pins", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetPins)))
+	mux.Handle("POST /api/chat/pins", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.PinMessage)))
+	mux.Handle("DELETE /api/chat/pins", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.UnpinMessage)))
+	mux.Handle("GET /api/chat/search", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.SearchMessages)))
+	mux.Handle("GET /api/chat/thread", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetThread)))
 	mux.Handle("GET /api/chat/users", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetAllUsers)))
+	mux.Handle("GET /api/chat/presence", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.GetPresence)))
 	mux.Handle("GET /api/chat/ws", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.HandleWebSocket)))
+	mux.Handle("GET /api/chat/stream", middleware.RequireAuth(sessRepo, http.HandlerFunc(chatH.StreamEvents)))
+
+	// Attachments API
+	mux.Handle("POST /api/attachments", middleware.RequireAuth(sessRepo, http.HandlerFunc(attachmentH.Upload)))
+	mux.Handle("GET /api/attachments/{id}", middleware.RequireAuth(sessRepo, http.HandlerFunc(attachmentH.Download)))
 
 	// Serve static files with SPA fallback
 	mux.HandleFunc("/", spaHandler("./frontend/build"))
@@ -73,6 +182,32 @@ func main() {
 	log.Fatal(http.ListenAndServe(":8080", handler))
 }
 
+// envFloat reads a non-negative number, or returns def if the variable is unset.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Fatalf("%s must be a non-negative number", name)
+	}
+	return f
+}
+
+// envDuration reads a positive duration such as "90m", or returns def if the variable is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration like 24h", name)
+	}
+	return d
+}
+
 // SPA Handler - returns index.html for all non-API routes
 func spaHandler(buildDir string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -101,8 +236,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 		}
 
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
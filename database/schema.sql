@@ -9,6 +9,19 @@ CREATE TABLE IF NOT EXISTS users (
     last_name VARCHAR(100) NOT NULL,
     bio TEXT,
     avatar_url TEXT,
+    -- Public handle, unique regardless of case; see services.ValidateUsername.
+    username VARCHAR(32),
+    username_changed_at TIMESTAMP,
+    last_seen_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+    );
+
+-- Usernames given up in a change, lower-cased. Until expires_at they still
+-- lead to their previous owner and nobody else can take them.
+CREATE TABLE IF NOT EXISTS username_redirects (
+                                                  username VARCHAR(32) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
     created_at TIMESTAMP DEFAULT NOW()
     );
 
@@ -24,9 +37,44 @@ CREATE TABLE IF NOT EXISTS posts (
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     content TEXT NOT NULL,
     created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    edited_at TIMESTAMP,
+    -- Kept in step with likes and comments by PostRepo; cmd/recount fixes drift.
+    likes_count INT NOT NULL DEFAULT 0,
+    comments_count INT NOT NULL DEFAULT 0,
+    -- Soft delete; moderators can restore.
+    deleted_at TIMESTAMP,
+    deleted_by UUID REFERENCES users(id) ON DELETE SET NULL
+    );
+
+-- Popular feed ranking, refreshed periodically; see PostRepo.RefreshScores.
+CREATE TABLE IF NOT EXISTS post_scores (
+                                           post_id UUID PRIMARY KEY REFERENCES posts(id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
     updated_at TIMESTAMP DEFAULT NOW()
     );
 
+-- Earlier versions of edited posts. created_at is when the version was
+-- written, replaced_at/replaced_by record the edit that superseded it.
+CREATE TABLE IF NOT EXISTS post_revisions (
+                                              id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    post_id UUID NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    replaced_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    replaced_at TIMESTAMP DEFAULT NOW()
+    );
+
+-- Hashtags found in post content, in the normal form of internal/hashtag.
+-- created_at is the post's, so tags can be listed and counted by post age
+-- without touching posts.
+CREATE TABLE IF NOT EXISTS post_tags (
+                                         post_id UUID NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    tag VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (post_id, tag)
+    );
+
 CREATE TABLE IF NOT EXISTS likes (
                                      id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -39,14 +87,36 @@ CREATE TABLE IF NOT EXISTS comments (
                                         id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     post_id UUID NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    parent_comment_id UUID REFERENCES comments(id) ON DELETE CASCADE,
+    depth INT NOT NULL DEFAULT 0, -- 0 for top-level comments
     content TEXT NOT NULL,
-    created_at TIMESTAMP DEFAULT NOW()
+    created_at TIMESTAMP DEFAULT NOW(),
+    edited_at TIMESTAMP,
+    -- Deleted comments that still have replies stay behind as tombstones.
+    deleted_at TIMESTAMP
+    );
+
+CREATE TABLE IF NOT EXISTS comment_likes (
+                                             id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    comment_id UUID NOT NULL REFERENCES comments(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(user_id, comment_id)
+    );
+
+CREATE TABLE IF NOT EXISTS follows (
+                                       follower_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    followee_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (follower_id, followee_id),
+    CHECK (follower_id <> followee_id)
     );
 
 CREATE TABLE IF NOT EXISTS conversations (
                                              id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     is_group BOOLEAN DEFAULT FALSE,
     name VARCHAR(255),
+    last_seq BIGINT NOT NULL DEFAULT 0, -- seq of the newest message
     created_at TIMESTAMP DEFAULT NOW()
     );
 
@@ -55,6 +125,11 @@ CREATE TABLE IF NOT EXISTS conversation_participants (
     conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     joined_at TIMESTAMP DEFAULT NOW(),
+    role VARCHAR(20) NOT NULL DEFAULT 'member', -- member or admin; only used in groups
+    -- Personal settings of this participant
+    muted_until TIMESTAMP,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    pinned_at TIMESTAMP,
     UNIQUE(conversation_id, user_id)
     );
 
@@ -63,13 +138,140 @@ CREATE TABLE IF NOT EXISTS messages (
     conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     content TEXT NOT NULL,
+    seq BIGINT NOT NULL, -- gapless per conversation, taken from conversations.last_seq
+    client_msg_id VARCHAR(64), -- sender-chosen ID used to drop retried sends
+    reply_to_message_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    edited_at TIMESTAMP,
+    deleted_at TIMESTAMP,
+    -- Users write in both Russian and English, so index both stemmings.
+    search_vector TSVECTOR GENERATED ALWAYS AS (
+        to_tsvector('russian', content) || to_tsvector('english', content)
+    ) STORED,
+    UNIQUE(conversation_id, seq),
+    UNIQUE(conversation_id, user_id, client_msg_id)
+    );
+
+-- Previous versions of edited messages. Cleared when the message is deleted.
+CREATE TABLE IF NOT EXISTS message_edits (
+                                             id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    edited_at TIMESTAMP DEFAULT NOW()
+    );
+
+CREATE TABLE IF NOT EXISTS message_reactions (
+                                                 id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(message_id, user_id, emoji)
+    );
+
+CREATE TABLE IF NOT EXISTS pinned_messages (
+                                               conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    pinned_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (conversation_id, message_id)
+    );
+
+-- Uploaded files. An attachment belongs to at most one message or post;
+-- until it is linked only the uploader can see it.
+CREATE TABLE IF NOT EXISTS attachments (
+                                           id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    uploader_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL UNIQUE,
+    filename VARCHAR(255) NOT NULL,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    post_id UUID REFERENCES posts(id) ON DELETE CASCADE,
+    -- Image pipeline: status is NULL for non-images, otherwise
+    -- pending -> processing -> done | failed.
+    image_status VARCHAR(20),
+    image_attempts INT NOT NULL DEFAULT 0,
+    image_claimed_at TIMESTAMP,
+    image_error TEXT,
+    width INT,
+    height INT,
+    blurhash VARCHAR(64),
+    created_at TIMESTAMP DEFAULT NOW(),
+    CHECK (message_id IS NULL OR post_id IS NULL)
+    );
+
+CREATE TABLE IF NOT EXISTS attachment_thumbnails (
+                                                     attachment_id UUID NOT NULL REFERENCES attachments(id) ON DELETE CASCADE,
+    size INT NOT NULL,
+    storage_key TEXT NOT NULL UNIQUE,
+    content_type VARCHAR(100) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    PRIMARY KEY (attachment_id, size)
+    );
+
+-- @mentions that named a user, in exactly one post, comment or message.
+-- Offsets are in UTF-16 code units of the content, as clients index strings.
+CREATE TABLE IF NOT EXISTS mentions (
+                                        id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    post_id UUID REFERENCES posts(id) ON DELETE CASCADE,
+    comment_id UUID REFERENCES comments(id) ON DELETE CASCADE,
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    handle VARCHAR(64) NOT NULL,
+    offset_utf16 INT NOT NULL,
+    length_utf16 INT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    CHECK (num_nonnulls(post_id, comment_id, message_id) = 1)
+    );
+
+-- Chat events too large for a NOTIFY payload; see internal/broker.
+CREATE TABLE IF NOT EXISTS chat_event_payloads (
+                                                   id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    payload BYTEA NOT NULL,
     created_at TIMESTAMP DEFAULT NOW()
     );
 
-CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts(user_id);
-CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at DESC);
+-- Open chat sockets on every app instance, so presence is the same whichever
+-- instance is asked. Instances refresh heartbeat_at for their own sockets;
+-- rows left behind by a crashed instance go stale and are swept.
+CREATE TABLE IF NOT EXISTS presence_connections (
+                                                    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    away BOOLEAN NOT NULL DEFAULT FALSE,
+    heartbeat_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username ON users(LOWER(username));
+CREATE INDEX IF NOT EXISTS idx_username_redirects_user_id ON username_redirects(user_id);
+CREATE INDEX IF NOT EXISTS idx_posts_user_id ON posts(user_id, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_posts_created_at ON posts(created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_post_revisions_post_id ON post_revisions(post_id);
+CREATE INDEX IF NOT EXISTS idx_post_scores_score ON post_scores(score DESC, post_id DESC);
+CREATE INDEX IF NOT EXISTS idx_post_tags_tag ON post_tags(tag, created_at DESC, post_id DESC);
+CREATE INDEX IF NOT EXISTS idx_post_tags_created_at ON post_tags(created_at);
+CREATE INDEX IF NOT EXISTS idx_follows_followee_id ON follows(followee_id, created_at DESC);
 CREATE INDEX IF NOT EXISTS idx_likes_post_id ON likes(post_id);
-CREATE INDEX IF NOT EXISTS idx_comments_post_id ON comments(post_id);
+CREATE INDEX IF NOT EXISTS idx_comments_post_id ON comments(post_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_comments_parent_comment_id ON comments(parent_comment_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_comment_likes_comment_id ON comment_likes(comment_id);
 CREATE INDEX IF NOT EXISTS idx_messages_conversation_id ON messages(conversation_id);
 CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
-CREATE INDEX IF NOT EXISTS idx_conversation_participants_user_id ON conversation_participants(user_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to_message_id ON messages(reply_to_message_id);
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits(message_id);
+CREATE INDEX IF NOT EXISTS idx_message_reactions_message_id ON message_reactions(message_id);
+CREATE INDEX IF NOT EXISTS idx_conversation_participants_user_id ON conversation_participants(user_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_post_id ON attachments(post_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_image_pending ON attachments(created_at) WHERE image_status IN ('pending', 'processing');
+CREATE INDEX IF NOT EXISTS idx_mentions_user_id ON mentions(user_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_post_id ON mentions(post_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_comment_id ON mentions(comment_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_message_id ON mentions(message_id);
+CREATE INDEX IF NOT EXISTS idx_chat_event_payloads_created_at ON chat_event_payloads(created_at);
+CREATE INDEX IF NOT EXISTS idx_presence_connections_user_id ON presence_connections(user_id);
+CREATE INDEX IF NOT EXISTS idx_presence_connections_heartbeat_at ON presence_connections(heartbeat_at);
\ No newline at end of file
@@ -14,6 +14,7 @@ export default function AuthPage({ onLogin }) {
         last_name: '',
         bio: '',
         role: 'student',
+        username: '',
     })
 
     const handleLogin = async (e) => {
@@ -180,6 +181,14 @@ export default function AuthPage({ onLogin }) {
                                     required
                                 />
                             </Box>
+                            <TextField
+                                fullWidth
+                                label="Username (optional)"
+                                value={signupData.username}
+                                onChange={(e) => setSignupData({ ...signupData, username: e.target.value })}
+                                helperText="You can pick one later"
+                                sx={{ mb: 2 }}
+                            />
                             <TextField
                                 fullWidth
                                 label="Bio (optional)"
@@ -200,7 +209,6 @@ export default function AuthPage({ onLogin }) {
                             >
                                 <option value="student">Student</option>
                                 <option value="teacher">Teacher</option>
-                                <option value="admin">Admin</option>
                             </TextField>
                             <Button fullWidth variant="contained" type="submit" disabled={loading}>
                                 {loading ? 'Creating account...' : 'Create Account'}
@@ -45,6 +45,11 @@ export default function MessagesPage() {
 
     const messagesEndRef = useRef(null)
     const reconnectTimeoutRef = useRef(null)
+    const currentConvIdRef = useRef(null)
+
+    useEffect(() => {
+        currentConvIdRef.current = currentConv?.id ?? null
+    }, [currentConv])
 
     useEffect(() => {
         loadCurrentUser()
@@ -141,7 +146,8 @@ export default function MessagesPage() {
         newWs.onmessage = (event) => {
             try {
                 const data = JSON.parse(event.data)
-                if (data.type === 'message') {
+                // the socket receives every conversation; only show the open one
+                if (data.type === 'message' && data.conversation_id === currentConvIdRef.current) {
                     setMessages((prev) => [...prev, data])
                 }
             } catch (error) {
@@ -421,7 +427,7 @@ export default function MessagesPage() {
                                             {getInitials(user.first_name, user.last_name)}
                                         </Avatar>
                                     </ListItemAvatar>
-                                    <ListItemText primary={`${user.first_name} ${user.last_name}`} secondary={user.email} />
+                                    <ListItemText primary={`${user.first_name} ${user.last_name}`} secondary={user.username ? `@${user.username}` : ''} />
                                 </ListItemButton>
                             ))}
                         </List>
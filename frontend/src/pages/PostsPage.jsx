@@ -46,7 +46,7 @@ export default function PostsPage() {
             }
 
             const data = await res.json()
-            setPosts(data || [])
+            setPosts(data.posts || [])
         } catch (err) {
             console.error('Load posts error:', err)
             setError('Failed to load posts. Please try again.')
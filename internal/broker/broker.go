@@ -0,0 +1,14 @@
+package broker
+
+import "context"
+
+// Handler receives every payload published on any topic.
+type Handler func(topic string, payload []byte)
+
+// Broker fans published payloads out to all subscribers, possibly across
+// several app instances. Delivery is at-most-once and unordered between topics.
+type Broker interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Subscribe(h Handler)
+	Close() error
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBroker delivers payloads to subscribers in the same process.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(topic, payload)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, h)
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	notifyChannel = "chat_events"
+
+	// Postgres rejects NOTIFY payloads of 8000 bytes or more. Anything larger
+	// is stored in chat_event_payloads and only its row id is sent.
+	maxNotifyPayload = 7000
+
+	// Overflow rows only need to live long enough for every listener to fetch them.
+	overflowTTL     = 5 * time.Minute
+	cleanupInterval = time.Minute
+	reconnectDelay  = 2 * time.Second
+)
+
+// Notification payloads are either "i:<topic>\n<payload>" (inline) or "r:<id>" (overflow row).
+const (
+	inlinePrefix = "i:"
+	refPrefix    = "r:"
+)
+
+// PostgresBroker fans payloads out through LISTEN/NOTIFY on the existing pool,
+// so every app instance connected to the same database sees every event.
+type PostgresBroker struct {
+	pool   *pgxpool.Pool
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewPostgresBroker(pool *pgxpool.Pool) *PostgresBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &PostgresBroker{
+		pool:   pool,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+func (b *PostgresBroker) Publish(ctx context.Context, topic string, payload []byte) error {
+	msg := inlinePrefix + topic + "\n" + string(payload)
+	if len(msg) > maxNotifyPayload {
+		var id int64
+		err := b.pool.QueryRow(ctx, `
+			INSERT INTO chat_event_payloads (topic, payload)
+			VALUES ($1, $2)
+			RETURNING id
+		`, topic, payload).Scan(&id)
+		if err != nil {
+			return err
+		}
+		msg = refPrefix + strconv.FormatInt(id, 10)
+	}
+
+	_, err := b.pool.Exec(ctx, `SELECT pg_notify($1, $2)`, notifyChannel, msg)
+	return err
+}
+
+func (b *PostgresBroker) Subscribe(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, h)
+}
+
+func (b *PostgresBroker) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+// run keeps a dedicated LISTEN connection open, reconnecting on failure.
+// Events published while the listener is reconnecting are lost.
+func (b *PostgresBroker) run(ctx context.Context) {
+	defer close(b.done)
+
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Broker listen error:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (b *PostgresBroker) listen(ctx context.Context) error {
+	pooled, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The LISTEN connection is taken out of the pool for good.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return err
+	}
+
+	lastCleanup := time.Now()
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, cleanupInterval)
+		n, err := conn.WaitForNotification(waitCtx)
+		cancel()
+
+		if time.Since(lastCleanup) >= cleanupInterval {
+			b.cleanup(ctx)
+			lastCleanup = time.Now()
+		}
+
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				continue
+			}
+			return err
+		}
+		b.dispatch(ctx, n)
+	}
+}
+
+func (b *PostgresBroker) dispatch(ctx context.Context, n *pgconn.Notification) {
+	var topic string
+	var payload []byte
+
+	switch {
+	case strings.HasPrefix(n.Payload, inlinePrefix):
+		rest := strings.TrimPrefix(n.Payload, inlinePrefix)
+		i := strings.IndexByte(rest, '\n')
+		if i < 0 {
+			log.Println("Broker: malformed notification")
+			return
+		}
+		topic, payload = rest[:i], []byte(rest[i+1:])
+
+	case strings.HasPrefix(n.Payload, refPrefix):
+		id, err := strconv.ParseInt(strings.TrimPrefix(n.Payload, refPrefix), 10, 64)
+		if err != nil {
+			log.Println("Broker: malformed notification:", err)
+			return
+		}
+		err = b.pool.QueryRow(ctx, `
+			SELECT topic, payload FROM chat_event_payloads WHERE id = $1
+		`, id).Scan(&topic, &payload)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				log.Printf("Broker: overflow payload %d expired", id)
+			} else {
+				log.Println("Broker: error loading overflow payload:", err)
+			}
+			return
+		}
+
+	default:
+		log.Println("Broker: unknown notification format")
+		return
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(topic, payload)
+	}
+}
+
+func (b *PostgresBroker) cleanup(ctx context.Context) {
+	_, err := b.pool.Exec(ctx, `
+		DELETE FROM chat_event_payloads WHERE created_at < NOW() - make_interval(secs => $1)
+	`, overflowTTL.Seconds())
+	if err != nil && ctx.Err() == nil {
+		log.Println("Broker: error cleaning overflow payloads:", err)
+	}
+}
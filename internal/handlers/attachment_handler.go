@@ -0,0 +1,262 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"aitu-connect/internal/middleware"
+	"aitu-connect/internal/repo"
+	"aitu-connect/internal/services"
+	"aitu-connect/internal/storage"
+)
+
+const maxUploadSize = 20 << 20
+
+// allowedUploadTypes maps a sniffed content type to the type we store and
+// serve. Office documents sniff as zip archives, so they are told apart by
+// extension in uploadContentType.
+var allowedUploadTypes = map[string]string{
+	"image/jpeg":                "image/jpeg",
+	"image/png":                 "image/png",
+	"image/gif":                 "image/gif",
+	"image/webp":                "image/webp",
+	"application/pdf":           "application/pdf",
+	"text/plain; charset=utf-8": "text/plain; charset=utf-8",
+}
+
+// Images the pipeline in services.ImageWorker can process.
+var processableImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+var officeTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".zip":  "application/zip",
+}
+
+type AttachmentHandler struct {
+	attachments *repo.AttachmentRepo
+	store       storage.Storage
+	images      *services.ImageWorker
+}
+
+func NewAttachmentHandler(attachments *repo.AttachmentRepo, store storage.Storage, images *services.ImageWorker) *AttachmentHandler {
+	return &AttachmentHandler{attachments: attachments, store: store, images: images}
+}
+
+// Upload accepts a multipart form with a single "file" field. The returned
+// ID is passed as attachment_ids when sending a message or creating a post.
+func (h *AttachmentHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeJSON(w, 413, map[string]string{"error": "file too large"})
+			return
+		}
+		writeJSON(w, 400, map[string]string{"error": "file is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxUploadSize {
+		writeJSON(w, 413, map[string]string{"error": "file too large"})
+		return
+	}
+	if header.Size == 0 {
+		writeJSON(w, 400, map[string]string{"error": "file is empty"})
+		return
+	}
+
+	// Trust the bytes, not the client-supplied Content-Type.
+	buffered := bufio.NewReaderSize(file, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		writeJSON(w, 400, map[string]string{"error": "could not read file"})
+		return
+	}
+	filename := cleanFilename(header.Filename)
+	contentType, ok := uploadContentType(http.DetectContentType(head), filename)
+	if !ok {
+		writeJSON(w, 415, map[string]string{"error": "file type not allowed"})
+		return
+	}
+
+	key, err := newStorageKey()
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.store.Put(r.Context(), key, buffered, header.Size, contentType); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	a := &repo.Attachment{
+		UploaderID:  userID,
+		StorageKey:  key,
+		Filename:    filename,
+		ContentType: contentType,
+		SizeBytes:   header.Size,
+	}
+	if processableImageTypes[contentType] {
+		a.ImageStatus = repo.ImagePending
+	}
+	if err := h.attachments.Create(r.Context(), a); err != nil {
+		if delErr := h.store.Delete(r.Context(), key); delErr != nil {
+			log.Println("Error removing orphaned upload:", delErr)
+		}
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if a.ImageStatus == repo.ImagePending {
+		h.images.Kick()
+	}
+
+	writeJSON(w, 201, a)
+}
+
+// Download streams an attachment. Images also accept ?thumb=<size> for one
+// of the generated thumbnails.
+func (h *AttachmentHandler) Download(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	id := r.PathValue("id")
+	allowed, err := h.attachments.CanAccess(r.Context(), id, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if !allowed {
+		// Don't reveal whether the attachment exists.
+		writeJSON(w, 404, map[string]string{"error": "attachment not found"})
+		return
+	}
+
+	a, err := h.attachments.GetByID(r.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "attachment not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Until the pipeline has stripped EXIF (GPS included), only the uploader
+	// sees the original. If processing failed for good, nobody else ever does.
+	if a.ImageStatus != "" && a.ImageStatus != repo.ImageDone && a.UploaderID != userID {
+		if a.ImageStatus == repo.ImageFailed {
+			writeJSON(w, 404, map[string]string{"error": "image could not be processed"})
+			return
+		}
+		writeJSON(w, 409, map[string]string{"error": "image is still processing"})
+		return
+	}
+
+	key, contentType, size := a.StorageKey, a.ContentType, a.SizeBytes
+	if thumb := r.URL.Query().Get("thumb"); thumb != "" {
+		t, ok := findThumbnail(a, thumb)
+		if !ok {
+			writeJSON(w, 404, map[string]string{"error": "thumbnail not found"})
+			return
+		}
+		key, contentType, size = t.StorageKey, t.ContentType, t.SizeBytes
+	}
+
+	body, err := h.store.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeJSON(w, 404, map[string]string{"error": "attachment not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") || contentType == "application/pdf" {
+		disposition = "inline"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if _, err := io.Copy(w, body); err != nil {
+		log.Println("Error streaming attachment:", err)
+	}
+}
+
+func findThumbnail(a *repo.Attachment, size string) (repo.Thumbnail, bool) {
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return repo.Thumbnail{}, false
+	}
+	for _, t := range a.Thumbnails {
+		if t.Size == n {
+			return t, true
+		}
+	}
+	return repo.Thumbnail{}, false
+}
+
+func uploadContentType(sniffed, filename string) (string, bool) {
+	if t, ok := allowedUploadTypes[sniffed]; ok {
+		return t, true
+	}
+	if sniffed == "application/zip" {
+		t, ok := officeTypes[strings.ToLower(filepath.Ext(filename))]
+		return t, ok
+	}
+	return "", false
+}
+
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		return "file"
+	}
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[len(name)-255:], "")
+	}
+	return name
+}
+
+func newStorageKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "attachments/" + hex.EncodeToString(b), nil
+}
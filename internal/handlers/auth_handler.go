@@ -22,7 +22,8 @@ type signUpReq struct {
 	Role      string `json:"role"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
-	Bio       string `json:"bio"` // optional
+	Bio       string `json:"bio"`      // optional
+	Username  string `json:"username"` // optional
 }
 
 type signInReq struct {
@@ -51,6 +52,7 @@ func (h *AuthHandler) SignUp(w http.ResponseWriter, r *http.Request) {
 		req.FirstName,
 		req.LastName,
 		req.Bio,
+		req.Username,
 	)
 	if err != nil {
 		writeJSON(w, 400, map[string]string{"error": err.Error()})
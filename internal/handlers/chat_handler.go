@@ -1,39 +1,58 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 
 	"aitu-connect/internal/middleware"
 	"aitu-connect/internal/repo"
+	"aitu-connect/internal/services"
 )
 
 type ChatHandler struct {
-	chats    *repo.ChatRepo
-	users    *repo.UserRepo
-	upgrader websocket.Upgrader
-	clients  map[string]map[*websocket.Conn]*clientInfo
-	mu       sync.RWMutex
+	chat        *services.ChatService
+	chats       *repo.ChatRepo
+	users       *repo.UserRepo
+	attachments *repo.AttachmentRepo
+	upgrader    websocket.Upgrader
+	clients     map[string]map[*subscriber]struct{} // conversationID -> connections
+	byUser      map[string]map[*subscriber]struct{} // userID -> connections
+	mu          sync.RWMutex
+	presence    *presenceTracker
+	typing      *typingTracker
 }
 
-type clientInfo struct {
-	userID string
-}
-
-func NewChatHandler(chats *repo.ChatRepo, users *repo.UserRepo) *ChatHandler {
-	return &ChatHandler{
-		chats: chats,
-		users: users,
+func NewChatHandler(chat *services.ChatService, chats *repo.ChatRepo, users *repo.UserRepo, attachments *repo.AttachmentRepo, presence *repo.PresenceRepo) *ChatHandler {
+	h := &ChatHandler{
+		chat:        chat,
+		chats:       chats,
+		users:       users,
+		attachments: attachments,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
-		clients: make(map[string]map[*websocket.Conn]*clientInfo),
+		clients:  make(map[string]map[*subscriber]struct{}),
+		byUser:   make(map[string]map[*subscriber]struct{}),
+		presence: newPresenceTracker(presence),
+		typing:   newTypingTracker(),
 	}
+	chat.Subscribe(h.deliver)
+	return h
 }
 
 func (h *ChatHandler) GetConversations(w http.ResponseWriter, r *http.Request) {
@@ -43,7 +62,8 @@ func (h *ChatHandler) GetConversations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	convs, err := h.chats.GetUserConversations(r.Context(), userID)
+	includeArchived := r.URL.Query().Get("include_archived") == "true"
+	convs, err := h.chats.GetUserConversations(r.Context(), userID, includeArchived)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
@@ -76,17 +96,100 @@ func (h *ChatHandler) GetOrCreateConversation(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// Sockets opened before the conversation existed start receiving it right away.
+	h.chat.SubscribeUser(convID, userID)
+	h.chat.SubscribeUser(convID, otherUserID)
+
 	writeJSON(w, 200, map[string]string{"conversation_id": convID})
 }
 
+// updateSettingsReq carries the fields to change; omitted fields stay as they are.
+// muted_until is an RFC 3339 time, or "" to unmute.
+type updateSettingsReq struct {
+	MutedUntil *string `json:"muted_until"`
+	Archived   *bool   `json:"archived"`
+	Pinned     *bool   `json:"pinned"`
+}
+
+func (h *ChatHandler) UpdateConversationSettings(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req updateSettingsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+
+	settings := repo.ConversationSettings{Archived: req.Archived, Pinned: req.Pinned}
+	if req.MutedUntil != nil {
+		var until time.Time
+		if *req.MutedUntil != "" {
+			t, err := time.Parse(time.RFC3339, *req.MutedUntil)
+			if err != nil {
+				writeJSON(w, 400, map[string]string{"error": "muted_until must be RFC 3339"})
+				return
+			}
+			until = t
+		}
+		settings.MutedUntil = &until
+	}
+
+	convID := r.PathValue("id")
+	err := h.chats.UpdateSettings(r.Context(), convID, userID, settings)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "conversation not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Keep the user's other devices in sync.
+	h.chat.SendToUsers([]string{userID}, map[string]interface{}{
+		"type":            "conversation_settings",
+		"conversation_id": convID,
+		"muted_until":     req.MutedUntil,
+		"archived":        req.Archived,
+		"pinned":          req.Pinned,
+	})
+
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
 func (h *ChatHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
 	conversationID := r.URL.Query().Get("conversation_id")
 	if conversationID == "" {
 		writeJSON(w, 400, map[string]string{"error": "conversation_id is required"})
 		return
 	}
 
-	messages, err := h.chats.GetMessages(r.Context(), conversationID, 100)
+	if !h.isMember(r.Context(), conversationID, userID) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return
+	}
+
+	var afterSeq int64
+	if v := r.URL.Query().Get("after_seq"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeJSON(w, 400, map[string]string{"error": "after_seq must be a non-negative integer"})
+			return
+		}
+		afterSeq = n
+	}
+
+	messages, err := h.chats.GetMessages(r.Context(), conversationID, userID, afterSeq, 100)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
@@ -100,6 +203,566 @@ func (h *ChatHandler) GetMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
+// Authors may fix a message shortly after sending it, and unsend it for longer.
+const (
+	messageEditWindow   = 15 * time.Minute
+	messageDeleteWindow = 24 * time.Hour
+)
+
+type editMessageReq struct {
+	Content string `json:"content"`
+}
+
+func (h *ChatHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req editMessageReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+	if req.Content == "" {
+		writeJSON(w, 400, map[string]string{"error": "content is required"})
+		return
+	}
+
+	msg, ok := h.loadOwnMessage(w, r, userID, messageEditWindow)
+	if !ok {
+		return
+	}
+
+	editedAt, err := h.chats.EditMessage(r.Context(), msg.ID, req.Content)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Reload for the mentions found in the new content.
+	edited, err := h.chats.GetMessage(r.Context(), msg.ID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.chat.BroadcastToConversation(msg.ConversationID, map[string]interface{}{
+		"type":            "message_edited",
+		"id":              msg.ID,
+		"conversation_id": msg.ConversationID,
+		"content":         req.Content,
+		"mentions":        edited.Mentions,
+		"edited_at":       editedAt,
+	})
+	h.chat.NotifyMentioned(r.Context(), msg.Mentions, edited.Mentions, services.MessageMentionEvent(edited))
+
+	writeJSON(w, 200, edited)
+}
+
+func (h *ChatHandler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	msg, ok := h.loadOwnMessage(w, r, userID, messageDeleteWindow)
+	if !ok {
+		return
+	}
+
+	deletedAt, err := h.chats.DeleteMessage(r.Context(), msg.ID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.chat.BroadcastToConversation(msg.ConversationID, map[string]interface{}{
+		"type":            "message_deleted",
+		"id":              msg.ID,
+		"conversation_id": msg.ConversationID,
+		"deleted_at":      deletedAt,
+	})
+
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// loadOwnMessage fetches the {id} message and checks that userID wrote it,
+// that it isn't deleted and that it is still inside window. On failure it
+// writes the error response and returns false.
+func (h *ChatHandler) loadOwnMessage(w http.ResponseWriter, r *http.Request, userID string, window time.Duration) (*repo.Message, bool) {
+	msg, err := h.chats.GetMessage(r.Context(), r.PathValue("id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "message not found"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	switch {
+	case msg.UserID != userID:
+		writeJSON(w, 403, map[string]string{"error": "only the author can change this message"})
+		return nil, false
+	case msg.IsDeleted:
+		writeJSON(w, 409, map[string]string{"error": "message was deleted"})
+		return nil, false
+	case time.Since(msg.CreatedAt) > window:
+		writeJSON(w, 403, map[string]string{"error": "message is too old to change"})
+		return nil, false
+	}
+	return msg, true
+}
+
+func (h *ChatHandler) GetMessageHistory(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	msg, err := h.chats.GetMessage(r.Context(), r.PathValue("id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "message not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if !h.isMember(r.Context(), msg.ConversationID, userID) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return
+	}
+
+	edits, err := h.chats.GetMessageEdits(r.Context(), msg.ID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if edits == nil {
+		edits = []repo.MessageEdit{}
+	}
+
+	writeJSON(w, 200, edits)
+}
+
+const (
+	maxReactionEmojis = 20 // different emojis per message
+	maxEmojiBytes     = 32
+)
+
+type reactionReq struct {
+	Emoji string `json:"emoji"`
+}
+
+func (h *ChatHandler) AddReaction(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req reactionReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+	if !validEmoji(req.Emoji) {
+		writeJSON(w, 400, map[string]string{"error": "emoji is invalid"})
+		return
+	}
+
+	msg, ok := h.loadReactableMessage(w, r, userID)
+	if !ok {
+		return
+	}
+
+	count, err := h.chats.AddReaction(r.Context(), msg.ID, userID, req.Emoji, maxReactionEmojis)
+	if errors.Is(err, repo.ErrReactionLimit) {
+		writeJSON(w, 409, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.broadcastReaction(msg, userID, req.Emoji, "add", count)
+	writeJSON(w, 200, map[string]interface{}{"emoji": req.Emoji, "count": count, "reacted_by_me": true})
+}
+
+func (h *ChatHandler) RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	emoji := r.URL.Query().Get("emoji")
+	if emoji == "" {
+		writeJSON(w, 400, map[string]string{"error": "emoji is required"})
+		return
+	}
+	if !validEmoji(emoji) {
+		writeJSON(w, 400, map[string]string{"error": "emoji is invalid"})
+		return
+	}
+
+	msg, ok := h.loadReactableMessage(w, r, userID)
+	if !ok {
+		return
+	}
+
+	count, err := h.chats.RemoveReaction(r.Context(), msg.ID, userID, emoji)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.broadcastReaction(msg, userID, emoji, "remove", count)
+	writeJSON(w, 200, map[string]interface{}{"emoji": emoji, "count": count, "reacted_by_me": false})
+}
+
+// loadReactableMessage fetches the {id} message and checks that userID can
+// see it and that it still exists. On failure it writes the error response.
+func (h *ChatHandler) loadReactableMessage(w http.ResponseWriter, r *http.Request, userID string) (*repo.Message, bool) {
+	msg, err := h.chats.GetMessage(r.Context(), r.PathValue("id"))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "message not found"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if !h.isMember(r.Context(), msg.ConversationID, userID) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return nil, false
+	}
+	if msg.IsDeleted {
+		writeJSON(w, 409, map[string]string{"error": "message was deleted"})
+		return nil, false
+	}
+	return msg, true
+}
+
+// broadcastReaction tells members the new count for one emoji. Clients set
+// their own reacted_by_me flag when user_id is theirs.
+func (h *ChatHandler) broadcastReaction(msg *repo.Message, userID, emoji, action string, count int) {
+	h.chat.BroadcastToConversation(msg.ConversationID, map[string]interface{}{
+		"type":            "reaction",
+		"action":          action,
+		"message_id":      msg.ID,
+		"conversation_id": msg.ConversationID,
+		"user_id":         userID,
+		"emoji":           emoji,
+		"count":           count,
+	})
+}
+
+type threadResp struct {
+	Parent  *repo.Message  `json:"parent"`
+	Replies []repo.Message `json:"replies"`
+}
+
+// GetThread lists the replies to message_id along with the message itself.
+func (h *ChatHandler) GetThread(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	messageID := r.URL.Query().Get("message_id")
+	if messageID == "" {
+		writeJSON(w, 400, map[string]string{"error": "message_id is required"})
+		return
+	}
+
+	parent, err := h.chats.GetMessage(r.Context(), messageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "message not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if !h.isMember(r.Context(), parent.ConversationID, userID) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return
+	}
+
+	replies, err := h.chats.GetThread(r.Context(), parent.ID, userID, 200)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if replies == nil {
+		replies = []repo.Message{}
+	}
+
+	writeJSON(w, 200, threadResp{Parent: parent, Replies: replies})
+}
+
+const maxPinnedMessages = 10
+
+type pinReq struct {
+	MessageID string `json:"message_id"`
+}
+
+func (h *ChatHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req pinReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+
+	msg, ok := h.loadPinnableMessage(w, r, userID, req.MessageID)
+	if !ok {
+		return
+	}
+	if msg.IsDeleted {
+		writeJSON(w, 409, map[string]string{"error": "message was deleted"})
+		return
+	}
+
+	pinnedAt, err := h.chats.PinMessage(r.Context(), msg.ConversationID, msg.ID, userID, maxPinnedMessages)
+	if errors.Is(err, repo.ErrPinLimit) {
+		writeJSON(w, 409, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.chat.BroadcastToConversation(msg.ConversationID, map[string]interface{}{
+		"type":            "message_pinned",
+		"conversation_id": msg.ConversationID,
+		"message_id":      msg.ID,
+		"pinned_by":       userID,
+		"pinned_at":       pinnedAt,
+	})
+
+	writeJSON(w, 200, map[string]interface{}{"message_id": msg.ID, "pinned_at": pinnedAt})
+}
+
+func (h *ChatHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	msg, ok := h.loadPinnableMessage(w, r, userID, r.URL.Query().Get("message_id"))
+	if !ok {
+		return
+	}
+
+	removed, err := h.chats.UnpinMessage(r.Context(), msg.ConversationID, msg.ID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if removed {
+		h.chat.BroadcastToConversation(msg.ConversationID, map[string]interface{}{
+			"type":            "message_unpinned",
+			"conversation_id": msg.ConversationID,
+			"message_id":      msg.ID,
+			"unpinned_by":     userID,
+		})
+	}
+
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// loadPinnableMessage fetches a message and checks that userID may change
+// its conversation's pins: group admins, or either participant of a DM.
+// On failure it writes the error response and returns false.
+func (h *ChatHandler) loadPinnableMessage(w http.ResponseWriter, r *http.Request, userID, messageID string) (*repo.Message, bool) {
+	if messageID == "" {
+		writeJSON(w, 400, map[string]string{"error": "message_id is required"})
+		return nil, false
+	}
+
+	msg, err := h.chats.GetMessage(r.Context(), messageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "message not found"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	isGroup, role, err := h.chats.GetParticipant(r.Context(), msg.ConversationID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if isGroup && role != repo.RoleAdmin {
+		writeJSON(w, 403, map[string]string{"error": "only group admins can pin messages"})
+		return nil, false
+	}
+	return msg, true
+}
+
+func (h *ChatHandler) GetPins(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	conversationID := r.URL.Query().Get("conversation_id")
+	if conversationID == "" {
+		writeJSON(w, 400, map[string]string{"error": "conversation_id is required"})
+		return
+	}
+	if !h.isMember(r.Context(), conversationID, userID) {
+		writeJSON(w, 403, map[string]string{"error": "not a participant"})
+		return
+	}
+
+	pins, err := h.chats.GetPinnedMessages(r.Context(), conversationID, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if pins == nil {
+		pins = []repo.PinnedMessage{}
+	}
+
+	writeJSON(w, 200, pins)
+}
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	// Deeper pages make Postgres rank and skip every earlier match; past
+	// this, clients should narrow the search with from/to instead.
+	maxSearchOffset = 500
+)
+
+// SearchMessages runs a full-text search over the caller's conversations.
+// Query params: q (required), conversation_id, from/to (RFC 3339 or
+// YYYY-MM-DD; a bare "to" date includes that whole day), limit, offset.
+// Snippets are HTML-escaped with matches wrapped in <mark>.
+func (h *ChatHandler) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		writeJSON(w, 400, map[string]string{"error": "q is required"})
+		return
+	}
+	if id := q.Get("conversation_id"); id != "" && !repo.IsUUID(id) {
+		writeJSON(w, 400, map[string]string{"error": "invalid conversation_id"})
+		return
+	}
+
+	search := repo.MessageSearch{
+		UserID:         userID,
+		Query:          query,
+		Language:       searchLanguage(query),
+		ConversationID: q.Get("conversation_id"),
+		Limit:          defaultSearchLimit,
+	}
+
+	var err error
+	if search.From, err = parseSearchDate(q.Get("from"), false); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "from must be RFC 3339 or YYYY-MM-DD"})
+		return
+	}
+	if search.To, err = parseSearchDate(q.Get("to"), true); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "to must be RFC 3339 or YYYY-MM-DD"})
+		return
+	}
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		search.Limit = min(l, maxSearchLimit)
+	}
+	if o, err := strconv.Atoi(q.Get("offset")); err == nil && o >= 0 {
+		if o > maxSearchOffset {
+			writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("offset must be at most %d; narrow the search with from/to", maxSearchOffset)})
+			return
+		}
+		search.Offset = o
+	}
+
+	results, err := h.chats.SearchMessages(r.Context(), search)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if results == nil {
+		results = []repo.MessageSearchResult{}
+	}
+	for i := range results {
+		results[i].Snippet = highlightSnippet(results[i].Snippet)
+	}
+
+	writeJSON(w, 200, results)
+}
+
+// searchLanguage picks the stemming used to highlight matches. Matching
+// itself always uses both languages.
+func searchLanguage(query string) string {
+	for _, r := range query {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return "russian"
+		}
+	}
+	return "english"
+}
+
+func parseSearchDate(v string, endOfDay bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.Add(24 * time.Hour)
+	}
+	return &t, nil
+}
+
+func highlightSnippet(snippet string) string {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, repo.HighlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, repo.HighlightStop, "</mark>")
+}
+
 func (h *ChatHandler) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.UserIDFromContext(r.Context())
 	if !ok {
@@ -121,10 +784,91 @@ func (h *ChatHandler) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
+type presenceInfo struct {
+	UserID   string     `json:"user_id"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// maxPresenceIDs caps how many users one presence request may ask about.
+const maxPresenceIDs = 200
+
+// GetPresence reports online/away/offline and last-seen for a comma-separated
+// list of user_ids. Users the caller shares no conversation with are left out.
+func (h *ChatHandler) GetPresence(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var requested []string
+	for _, id := range strings.Split(r.URL.Query().Get("user_ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			if !repo.IsUUID(id) {
+				writeJSON(w, 400, map[string]string{"error": "invalid user id: " + id})
+				return
+			}
+			requested = append(requested, id)
+		}
+	}
+	if len(requested) == 0 {
+		writeJSON(w, 400, map[string]string{"error": "user_ids is required"})
+		return
+	}
+	if len(requested) > maxPresenceIDs {
+		writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("at most %d user_ids per request", maxPresenceIDs)})
+		return
+	}
+
+	// Only the caller and the people they chat with are visible.
+	peers, err := h.chats.GetPeerUserIDs(r.Context(), userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	visible := map[string]bool{userID: true}
+	for _, id := range peers {
+		visible[id] = true
+	}
+	var userIDs []string
+	for _, id := range requested {
+		if visible[strings.ToLower(id)] {
+			userIDs = append(userIDs, strings.ToLower(id))
+		}
+	}
+
+	result := make([]presenceInfo, 0, len(userIDs))
+	if len(userIDs) == 0 {
+		writeJSON(w, 200, result)
+		return
+	}
+
+	presence, err := h.presence.repo.GetPresence(r.Context(), userIDs)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	for _, id := range userIDs {
+		p, ok := presence[id]
+		if !ok {
+			p.Status = repo.PresenceOffline
+		}
+		result = append(result, presenceInfo{UserID: id, Status: p.Status, LastSeen: p.LastSeen})
+	}
+
+	writeJSON(w, 200, result)
+}
+
 type wsMessage struct {
-	Type           string `json:"type"`
-	ConversationID string `json:"conversation_id"`
-	Content        string `json:"content"`
+	Type             string   `json:"type"`
+	ConversationID   string   `json:"conversation_id"`
+	Content          string   `json:"content"`
+	Status           string   `json:"status"`
+	ReplyToMessageID string   `json:"reply_to_message_id"`
+	AttachmentIDs    []string `json:"attachment_ids"`
+	ClientMsgID      string   `json:"client_msg_id"`
 }
 
 func (h *ChatHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -141,93 +885,370 @@ func (h *ChatHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	var currentConvID string
+	// Every socket receives events for all of the user's conversations.
+	convIDs, err := h.chats.GetUserConversationIDs(r.Context(), userID)
+	if err != nil {
+		log.Println("Error loading conversations:", err)
+		return
+	}
+
+	client := newWSClient(conn, userID)
+	go client.writePump()
+	defer client.close("")
+
+	h.register(client.subscriber, convIDs)
+	defer h.unregister(client.subscriber)
+
+	h.connectPresence(r.Context(), client.subscriber)
+	defer h.disconnectPresence(client.subscriber)
 
 	for {
 		var msg wsMessage
 		err := conn.ReadJSON(&msg)
 		if err != nil {
-			log.Println("WebSocket read error:", err)
-			h.removeClient(currentConvID, conn)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println("WebSocket read error:", err)
+			}
 			break
 		}
 
 		switch msg.Type {
-		case "join":
-			if currentConvID != "" {
-				h.removeClient(currentConvID, conn)
+		case "subscribe", "join":
+			if !h.isMember(r.Context(), msg.ConversationID, userID) {
+				continue
 			}
-			currentConvID = msg.ConversationID
-			h.addClient(currentConvID, conn, userID)
+			h.subscribe(client.subscriber, msg.ConversationID)
 
-		case "message":
-			if msg.ConversationID == "" || msg.Content == "" {
+		case "unsubscribe":
+			h.unsubscribe(client.subscriber, msg.ConversationID)
+
+		case "typing_start":
+			if !h.isMember(r.Context(), msg.ConversationID, userID) {
 				continue
 			}
+			convID := msg.ConversationID
+			started := h.typing.start(convID, userID, func() {
+				h.broadcastTyping(convID, userID, false)
+			})
+			if started {
+				h.broadcastTyping(convID, userID, true)
+			}
 
-			msgID, err := h.chats.SaveMessage(r.Context(), msg.ConversationID, userID, msg.Content)
-			if err != nil {
-				log.Println("Error saving message:", err)
-				continue
+		case "typing_stop":
+			if h.typing.stop(msg.ConversationID, userID) {
+				h.broadcastTyping(msg.ConversationID, userID, false)
 			}
 
-			// Get user info
-			user, err := h.users.GetByID(r.Context(), userID)
+		case "presence":
+			if msg.Status != repo.PresenceOnline && msg.Status != repo.PresenceAway {
+				continue
+			}
+			change, err := h.presence.setAway(r.Context(), client.subscriber, msg.Status == repo.PresenceAway)
 			if err != nil {
-				log.Println("Error getting user:", err)
+				log.Println("Error updating presence:", err)
 				continue
 			}
-
-			broadcast := map[string]interface{}{
-				"type":              "message",
-				"id":                msgID,
-				"conversation_id":   msg.ConversationID,
-				"user_id":           userID,
-				"content":           msg.Content,
-				"author_first_name": user.FirstName,
-				"author_last_name":  user.LastName,
-				"created_at":        time.Now().Format(time.RFC3339),
+			if change.Changed {
+				h.notifyPresence(r.Context(), change)
 			}
 
-			h.broadcastToConversation(msg.ConversationID, broadcast)
+		case "message":
+			h.handleSend(r.Context(), client.subscriber, msg)
+		}
+	}
+}
+
+// Nack codes sent back when a message can't be delivered.
+const (
+	nackInvalid       = "invalid"
+	nackNotMember     = "not_member"
+	nackBadReply      = "bad_reply"
+	nackBadAttachment = "bad_attachment"
+	nackInternal      = "internal"
+)
+
+// sendErrorCode maps a ChatService.SendMessage error to a nack code and the
+// matching HTTP status.
+func sendErrorCode(err error) (string, int) {
+	switch {
+	case errors.Is(err, services.ErrEmptyMessage), errors.Is(err, services.ErrClientMsgIDTooLong):
+		return nackInvalid, 400
+	case errors.Is(err, services.ErrNotParticipant):
+		return nackNotMember, 403
+	case errors.Is(err, services.ErrBadReply):
+		return nackBadReply, 400
+	case errors.Is(err, repo.ErrBadAttachment):
+		return nackBadAttachment, 400
+	default:
+		return nackInternal, 500
+	}
+}
+
+func (m wsMessage) sendInput() services.SendMessageInput {
+	return services.SendMessageInput{
+		ConversationID:   m.ConversationID,
+		Content:          m.Content,
+		ReplyToMessageID: m.ReplyToMessageID,
+		AttachmentIDs:    m.AttachmentIDs,
+		ClientMsgID:      m.ClientMsgID,
+	}
+}
+
+// handleSend answers a WebSocket send. The sender's socket always gets an
+// ack carrying the stored id and seq, or a nack with an error code.
+func (h *ChatHandler) handleSend(ctx context.Context, client *subscriber, msg wsMessage) {
+	if h.typing.stop(msg.ConversationID, client.userID) {
+		h.broadcastTyping(msg.ConversationID, client.userID, false)
+	}
+
+	saved, duplicate, err := h.chat.SendMessage(ctx, client.userID, msg.sendInput())
+	if err != nil {
+		code, _ := sendErrorCode(err)
+		reason := err.Error()
+		if code == nackInternal {
+			log.Println("Error sending message:", err)
+			reason = "could not save message"
+		}
+		h.replyTo(client, map[string]interface{}{
+			"type":            "nack",
+			"client_msg_id":   msg.ClientMsgID,
+			"conversation_id": msg.ConversationID,
+			"code":            code,
+			"error":           reason,
+		})
+		return
+	}
+
+	h.replyTo(client, map[string]interface{}{
+		"type":            "ack",
+		"client_msg_id":   msg.ClientMsgID,
+		"conversation_id": msg.ConversationID,
+		"id":              saved.ID,
+		"seq":             saved.Seq,
+		"created_at":      saved.CreatedAt,
+		"duplicate":       duplicate,
+	})
+}
+
+// SendMessage is the HTTP counterpart of the WebSocket "message" op, for
+// bots, scripts and clients on the SSE stream. The body has the same fields
+// as the socket frame; the response is the stored message.
+func (h *ChatHandler) SendMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req wsMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "invalid json"})
+		return
+	}
+
+	if h.typing.stop(req.ConversationID, userID) {
+		h.broadcastTyping(req.ConversationID, userID, false)
+	}
+
+	saved, duplicate, err := h.chat.SendMessage(r.Context(), userID, req.sendInput())
+	if err != nil {
+		code, status := sendErrorCode(err)
+		if code == nackInternal {
+			log.Println("Error sending message:", err)
+			writeJSON(w, status, map[string]string{"error": "could not save message", "code": code})
+			return
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error(), "code": code})
+		return
+	}
+
+	status := 201
+	if duplicate {
+		status = 200
+	}
+	writeJSON(w, status, saved)
+}
+
+// replyTo queues an event on a single connection only.
+func (h *ChatHandler) replyTo(client *subscriber, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Error encoding reply:", err)
+		return
+	}
+	client.enqueue(payload)
+}
+
+func (h *ChatHandler) isMember(ctx context.Context, convID, userID string) bool {
+	if convID == "" {
+		return false
+	}
+	ok, err := h.chats.IsParticipant(ctx, convID, userID)
+	if err != nil {
+		log.Println("Error checking participant:", err)
+		return false
+	}
+	return ok
+}
+
+func (h *ChatHandler) broadcastTyping(convID, userID string, typing bool) {
+	eventType := "typing_stop"
+	if typing {
+		eventType = "typing_start"
+	}
+	h.chat.BroadcastToConversation(convID, map[string]interface{}{
+		"type":            eventType,
+		"conversation_id": convID,
+		"user_id":         userID,
+	})
+}
+
+func (h *ChatHandler) connectPresence(ctx context.Context, client *subscriber) {
+	change, err := h.presence.connect(ctx, client)
+	if err != nil {
+		log.Println("Error recording presence:", err)
+		return
+	}
+	if change.Changed {
+		h.notifyPresence(ctx, change)
+	}
+}
+
+func (h *ChatHandler) disconnectPresence(client *subscriber) {
+	ctx := context.Background()
+	change, err := h.presence.disconnect(ctx, client)
+	if err != nil {
+		log.Println("Error recording presence:", err)
+		return
+	}
+	if !change.Changed {
+		return
+	}
+
+	if change.Status == repo.PresenceOffline {
+		for _, convID := range h.typing.stopUser(client.userID) {
+			h.broadcastTyping(convID, client.userID, false)
 		}
 	}
+	h.notifyPresence(ctx, change)
+}
+
+// notifyPresence pushes a presence change to every user who shares a
+// conversation with the user, on every instance.
+func (h *ChatHandler) notifyPresence(ctx context.Context, change repo.PresenceChange) {
+	peerIDs, err := h.chats.GetPeerUserIDs(ctx, change.UserID)
+	if err != nil {
+		log.Println("Error loading peers for presence:", err)
+		return
+	}
+
+	h.chat.SendToUsers(peerIDs, map[string]interface{}{
+		"type":      "presence",
+		"user_id":   change.UserID,
+		"status":    change.Status,
+		"last_seen": change.LastSeen,
+	})
+}
+
+// RunPresence keeps this instance's presence records alive and announces
+// users whose instance went away without disconnecting them. It returns
+// when ctx is done.
+func (h *ChatHandler) RunPresence(ctx context.Context) {
+	h.presence.run(ctx, func(change repo.PresenceChange) {
+		h.notifyPresence(ctx, change)
+	})
+}
+
+// register adds a new socket to the per-user registry and subscribes it to convIDs.
+func (h *ChatHandler) register(client *subscriber, convIDs []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.byUser[client.userID] == nil {
+		h.byUser[client.userID] = make(map[*subscriber]struct{})
+	}
+	h.byUser[client.userID][client] = struct{}{}
+
+	for _, convID := range convIDs {
+		h.subscribeLocked(client, convID)
+	}
 }
 
-func (h *ChatHandler) addClient(convID string, conn *websocket.Conn, userID string) {
+// unregister drops a socket from the per-user registry and from every conversation it follows.
+func (h *ChatHandler) unregister(client *subscriber) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if h.clients[convID] == nil {
-		h.clients[convID] = make(map[*websocket.Conn]*clientInfo)
+	for convID := range client.convs {
+		h.unsubscribeLocked(client, convID)
+	}
+	delete(h.byUser[client.userID], client)
+	if len(h.byUser[client.userID]) == 0 {
+		delete(h.byUser, client.userID)
 	}
-	h.clients[convID][conn] = &clientInfo{userID: userID}
 }
 
-func (h *ChatHandler) removeClient(convID string, conn *websocket.Conn) {
+func (h *ChatHandler) subscribe(client *subscriber, convID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	h.subscribeLocked(client, convID)
+}
+
+func (h *ChatHandler) unsubscribe(client *subscriber, convID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribeLocked(client, convID)
+}
+
+func (h *ChatHandler) subscribeLocked(client *subscriber, convID string) {
+	if h.clients[convID] == nil {
+		h.clients[convID] = make(map[*subscriber]struct{})
+	}
+	h.clients[convID][client] = struct{}{}
+	client.convs[convID] = struct{}{}
+}
+
+func (h *ChatHandler) unsubscribeLocked(client *subscriber, convID string) {
+	delete(client.convs, convID)
 	if h.clients[convID] != nil {
-		delete(h.clients[convID], conn)
+		delete(h.clients[convID], client)
 		if len(h.clients[convID]) == 0 {
 			delete(h.clients, convID)
 		}
 	}
 }
 
-func (h *ChatHandler) broadcastToConversation(convID string, msg interface{}) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// deliver is the broker handler. Queuing never blocks; slow connections disconnect themselves.
+func (h *ChatHandler) deliver(topic string, payload []byte) {
+	switch {
+	case strings.HasPrefix(topic, services.TopicConversation):
+		convID := strings.TrimPrefix(topic, services.TopicConversation)
 
-	if clients, ok := h.clients[convID]; ok {
-		for conn := range clients {
-			err := conn.WriteJSON(msg)
-			if err != nil {
-				log.Println("Error broadcasting:", err)
-				conn.Close()
-				delete(clients, conn)
-			}
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		for client := range h.clients[convID] {
+			client.enqueue(payload)
+		}
+
+	case strings.HasPrefix(topic, services.TopicUser):
+		userID := strings.TrimPrefix(topic, services.TopicUser)
+
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		for client := range h.byUser[userID] {
+			client.enqueue(payload)
+		}
+
+	case strings.HasPrefix(topic, services.TopicSubscribe):
+		userID := strings.TrimPrefix(topic, services.TopicSubscribe)
+		convID := string(payload)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for client := range h.byUser[userID] {
+			h.subscribeLocked(client, convID)
 		}
 	}
 }
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"aitu-connect/internal/middleware"
+	"aitu-connect/internal/services"
+)
+
+const (
+	// Comment lines are written this often so proxies don't drop an idle stream.
+	streamKeepAlive = 25 * time.Second
+	// How long the browser waits before reconnecting a dropped stream.
+	streamRetry = 3 * time.Second
+	// Messages replayed on resume. A client that missed more is told to resync.
+	maxStreamReplay = 500
+)
+
+// streamHead is the part of an event the stream needs to decide on its id.
+type streamHead struct {
+	Type           string `json:"type"`
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Seq            int64  `json:"seq"`
+}
+
+// streamCursor is a stream's position: the seq of the newest message seen
+// in each conversation. Seqs are gapless and taken under the conversation's
+// row lock, so unlike created_at a message that commits late can't fall
+// behind a position already handed out.
+type streamCursor map[string]int64
+
+// streamCursorVersion starts every encoded cursor, so it is never empty
+// and ids from other formats are told apart.
+const streamCursorVersion = 1
+
+var errBadStreamCursor = errors.New("invalid stream cursor")
+
+func (c streamCursor) advance(convID string, seq int64) {
+	if seq > c[convID] {
+		c[convID] = seq
+	}
+}
+
+// String encodes the cursor for the SSE event id: a version byte, then per
+// conversation its 16-byte id and its seq as a uvarint, in base64url.
+func (c streamCursor) String() string {
+	buf := []byte{streamCursorVersion}
+	for _, id := range slices.Sorted(maps.Keys(c)) {
+		raw, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+		if err != nil || len(raw) != 16 {
+			continue
+		}
+		buf = append(buf, raw...)
+		buf = binary.AppendUvarint(buf, uint64(c[id]))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func parseStreamCursor(s string) (streamCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 || buf[0] != streamCursorVersion {
+		return nil, errBadStreamCursor
+	}
+	buf = buf[1:]
+
+	c := make(streamCursor)
+	for len(buf) > 0 {
+		if len(buf) <= 16 {
+			return nil, errBadStreamCursor
+		}
+		h := hex.EncodeToString(buf[:16])
+		seq, n := binary.Uvarint(buf[16:])
+		if n <= 0 {
+			return nil, errBadStreamCursor
+		}
+		c[h[:8]+"-"+h[8:12]+"-"+h[12:16]+"-"+h[16:20]+"-"+h[20:]] = int64(seq)
+		buf = buf[16+n:]
+	}
+	return c, nil
+}
+
+// StreamEvents is the Server-Sent Events fallback for clients that can't
+// hold a WebSocket. It carries exactly the events a socket receives, as
+// unnamed events whose data is the same JSON, and shares the socket
+// registry, so anything broadcast reaches both transports. Sends go
+// through POST /api/chat/messages.
+//
+// Message events carry a streamCursor as their id; on reconnect the browser
+// sends it back as Last-Event-ID (or the client passes ?last_event_id=) and
+// the messages stored after it are replayed before live events. Typing,
+// presence and other transient events are not replayed.
+func (h *ChatHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	// resumeFrom is nil for a fresh stream. An id that doesn't parse, e.g.
+	// one from before an upgrade, can't be resumed from, so the client is
+	// told to resync.
+	var resumeFrom streamCursor
+	resync := false
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		var err error
+		if resumeFrom, err = parseStreamCursor(lastEventID); err != nil {
+			resync = true
+		}
+	}
+
+	convIDs, err := h.chats.GetUserConversationIDs(r.Context(), userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(format string, args ...interface{}) bool {
+		rc.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !write("retry: %d\n\n", streamRetry.Milliseconds()) {
+		log.Println("SSE stream not supported by response writer")
+		return
+	}
+
+	// Register before replaying so nothing published in between is lost.
+	sub := newSubscriber(userID)
+	defer sub.close("")
+
+	h.register(sub, convIDs)
+	defer h.unregister(sub)
+
+	h.connectPresence(r.Context(), sub)
+	defer h.disconnectPresence(sub)
+
+	cursor := make(streamCursor)
+	replayed := make(map[string]struct{})
+	if resumeFrom != nil {
+		maps.Copy(cursor, resumeFrom)
+		messages, err := h.chats.GetMessagesAfter(r.Context(), userID, resumeFrom, maxStreamReplay)
+		if err != nil {
+			log.Println("Error loading messages to replay:", err)
+			return
+		}
+		for _, m := range messages {
+			payload, err := json.Marshal(services.NewMessageEvent(m))
+			if err != nil {
+				log.Println("Error encoding replayed message:", err)
+				continue
+			}
+			cursor.advance(m.ConversationID, m.Seq)
+			if !write("id: %s\ndata: %s\n\n", cursor, payload) {
+				return
+			}
+			replayed[m.ID] = struct{}{}
+		}
+		resync = len(messages) == maxStreamReplay
+	}
+
+	// A fresh or resynced stream starts at the newest message of every
+	// conversation; anything published since registering still arrives live.
+	if resumeFrom == nil || resync {
+		seqs, err := h.chats.GetConversationSeqs(r.Context(), userID)
+		if err != nil {
+			log.Println("Error loading conversation seqs:", err)
+			return
+		}
+		for convID, seq := range seqs {
+			cursor.advance(convID, seq)
+		}
+	}
+	if resync {
+		if !write("data: {\"type\":\"resync\"}\n\n") {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case payload := <-sub.send:
+			var head streamHead
+			if err := json.Unmarshal(payload, &head); err != nil {
+				log.Println("Error decoding chat event:", err)
+				continue
+			}
+			if head.Type != "message" || head.Seq == 0 {
+				if !write("data: %s\n\n", payload) {
+					return
+				}
+				continue
+			}
+			// Skip what was just replayed or what the client had before
+			// reconnecting.
+			if _, ok := replayed[head.ID]; ok || head.Seq <= resumeFrom[head.ConversationID] {
+				continue
+			}
+			cursor.advance(head.ConversationID, head.Seq)
+			if !write("id: %s\ndata: %s\n\n", cursor, payload) {
+				return
+			}
+
+		case <-ticker.C:
+			if !write(": ping\n\n") {
+				return
+			}
+
+		case <-sub.done:
+			// The browser reconnects with Last-Event-ID and catches up.
+			return
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
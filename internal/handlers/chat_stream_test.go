@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestStreamCursorRoundTrip(t *testing.T) {
+	tests := []streamCursor{
+		{},
+		{"3f2b8c1e-9d4a-4e57-8a61-0c2d9e7f1b34": 1},
+		{
+			"3f2b8c1e-9d4a-4e57-8a61-0c2d9e7f1b34": 42,
+			"00000000-0000-0000-0000-000000000001": 1 << 40,
+		},
+	}
+	for _, c := range tests {
+		s := c.String()
+		if s == "" {
+			t.Errorf("%v encoded to an empty id", c)
+		}
+		got, err := parseStreamCursor(s)
+		if err != nil {
+			t.Errorf("parseStreamCursor(%q): %v", s, err)
+			continue
+		}
+		if !maps.Equal(got, c) {
+			t.Errorf("round trip of %v gave %v", c, got)
+		}
+	}
+}
+
+func TestParseStreamCursorRejects(t *testing.T) {
+	for _, s := range []string{
+		"1700000000000000", // a created_at id from before seq cursors
+		"not base64!",
+		"AA",                     // wrong version
+		"AT8rjB6dSk5XimEMLZ5_Gw", // truncated conversation id
+	} {
+		if _, err := parseStreamCursor(s); err == nil {
+			t.Errorf("parseStreamCursor(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// emojiRunes holds the non-ASCII code points with the Unicode Emoji property
+// (emoji-data.txt, Unicode 15.1). The ASCII digits, '#' and '*' also have it
+// but only count as emoji inside a keycap sequence.
+var emojiRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1},
+		{0x00AE, 0x00AE, 1},
+		{0x203C, 0x203C, 1},
+		{0x2049, 0x2049, 1},
+		{0x2122, 0x2122, 1},
+		{0x2139, 0x2139, 1},
+		{0x2194, 0x2199, 1},
+		{0x21A9, 0x21AA, 1},
+		{0x231A, 0x231B, 1},
+		{0x2328, 0x2328, 1},
+		{0x23CF, 0x23CF, 1},
+		{0x23E9, 0x23F3, 1},
+		{0x23F8, 0x23FA, 1},
+		{0x24C2, 0x24C2, 1},
+		{0x25AA, 0x25AB, 1},
+		{0x25B6, 0x25B6, 1},
+		{0x25C0, 0x25C0, 1},
+		{0x25FB, 0x25FE, 1},
+		{0x2600, 0x2604, 1},
+		{0x260E, 0x260E, 1},
+		{0x2611, 0x2611, 1},
+		{0x2614, 0x2615, 1},
+		{0x2618, 0x2618, 1},
+		{0x261D, 0x261D, 1},
+		{0x2620, 0x2620, 1},
+		{0x2622, 0x2623, 1},
+		{0x2626, 0x2626, 1},
+		{0x262A, 0x262A, 1},
+		{0x262E, 0x262F, 1},
+		{0x2638, 0x263A, 1},
+		{0x2640, 0x2640, 1},
+		{0x2642, 0x2642, 1},
+		{0x2648, 0x2653, 1},
+		{0x265F, 0x2660, 1},
+		{0x2663, 0x2663, 1},
+		{0x2665, 0x2666, 1},
+		{0x2668, 0x2668, 1},
+		{0x267B, 0x267B, 1},
+		{0x267E, 0x267F, 1},
+		{0x2692, 0x2697, 1},
+		{0x2699, 0x2699, 1},
+		{0x269B, 0x269C, 1},
+		{0x26A0, 0x26A1, 1},
+		{0x26A7, 0x26A7, 1},
+		{0x26AA, 0x26AB, 1},
+		{0x26B0, 0x26B1, 1},
+		{0x26BD, 0x26BE, 1},
+		{0x26C4, 0x26C5, 1},
+		{0x26C8, 0x26C8, 1},
+		{0x26CE, 0x26CF, 1},
+		{0x26D1, 0x26D1, 1},
+		{0x26D3, 0x26D4, 1},
+		{0x26E9, 0x26EA, 1},
+		{0x26F0, 0x26F5, 1},
+		{0x26F7, 0x26FA, 1},
+		{0x26FD, 0x26FD, 1},
+		{0x2702, 0x2702, 1},
+		{0x2705, 0x2705, 1},
+		{0x2708, 0x270D, 1},
+		{0x270F, 0x270F, 1},
+		{0x2712, 0x2712, 1},
+		{0x2714, 0x2714, 1},
+		{0x2716, 0x2716, 1},
+		{0x271D, 0x271D, 1},
+		{0x2721, 0x2721, 1},
+		{0x2728, 0x2728, 1},
+		{0x2733, 0x2734, 1},
+		{0x2744, 0x2744, 1},
+		{0x2747, 0x2747, 1},
+		{0x274C, 0x274C, 1},
+		{0x274E, 0x274E, 1},
+		{0x2753, 0x2755, 1},
+		{0x2757, 0x2757, 1},
+		{0x2763, 0x2764, 1},
+		{0x2795, 0x2797, 1},
+		{0x27A1, 0x27A1, 1},
+		{0x27B0, 0x27B0, 1},
+		{0x27BF, 0x27BF, 1},
+		{0x2934, 0x2935, 1},
+		{0x2B05, 0x2B07, 1},
+		{0x2B1B, 0x2B1C, 1},
+		{0x2B50, 0x2B50, 1},
+		{0x2B55, 0x2B55, 1},
+		{0x3030, 0x3030, 1},
+		{0x303D, 0x303D, 1},
+		{0x3297, 0x3297, 1},
+		{0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F004, 0x1F004, 1},
+		{0x1F0CF, 0x1F0CF, 1},
+		{0x1F170, 0x1F171, 1},
+		{0x1F17E, 0x1F17F, 1},
+		{0x1F18E, 0x1F18E, 1},
+		{0x1F191, 0x1F19A, 1},
+		{0x1F1E6, 0x1F1FF, 1},
+		{0x1F201, 0x1F202, 1},
+		{0x1F21A, 0x1F21A, 1},
+		{0x1F22F, 0x1F22F, 1},
+		{0x1F232, 0x1F23A, 1},
+		{0x1F250, 0x1F251, 1},
+		{0x1F300, 0x1F321, 1},
+		{0x1F324, 0x1F393, 1},
+		{0x1F396, 0x1F397, 1},
+		{0x1F399, 0x1F39B, 1},
+		{0x1F39E, 0x1F3F0, 1},
+		{0x1F3F3, 0x1F3F5, 1},
+		{0x1F3F7, 0x1F4FD, 1},
+		{0x1F4FF, 0x1F53D, 1},
+		{0x1F549, 0x1F54E, 1},
+		{0x1F550, 0x1F567, 1},
+		{0x1F56F, 0x1F570, 1},
+		{0x1F573, 0x1F57A, 1},
+		{0x1F587, 0x1F587, 1},
+		{0x1F58A, 0x1F58D, 1},
+		{0x1F590, 0x1F590, 1},
+		{0x1F595, 0x1F596, 1},
+		{0x1F5A4, 0x1F5A5, 1},
+		{0x1F5A8, 0x1F5A8, 1},
+		{0x1F5B1, 0x1F5B2, 1},
+		{0x1F5BC, 0x1F5BC, 1},
+		{0x1F5C2, 0x1F5C4, 1},
+		{0x1F5D1, 0x1F5D3, 1},
+		{0x1F5DC, 0x1F5DE, 1},
+		{0x1F5E1, 0x1F5E1, 1},
+		{0x1F5E3, 0x1F5E3, 1},
+		{0x1F5E8, 0x1F5E8, 1},
+		{0x1F5EF, 0x1F5EF, 1},
+		{0x1F5F3, 0x1F5F3, 1},
+		{0x1F5FA, 0x1F64F, 1},
+		{0x1F680, 0x1F6C5, 1},
+		{0x1F6CB, 0x1F6D2, 1},
+		{0x1F6D5, 0x1F6D7, 1},
+		{0x1F6DC, 0x1F6E5, 1},
+		{0x1F6E9, 0x1F6E9, 1},
+		{0x1F6EB, 0x1F6EC, 1},
+		{0x1F6F0, 0x1F6F0, 1},
+		{0x1F6F3, 0x1F6FC, 1},
+		{0x1F7E0, 0x1F7EB, 1},
+		{0x1F7F0, 0x1F7F0, 1},
+		{0x1F90C, 0x1F93A, 1},
+		{0x1F93C, 0x1F945, 1},
+		{0x1F947, 0x1F9FF, 1},
+		{0x1FA70, 0x1FA7C, 1},
+		{0x1FA80, 0x1FA88, 1},
+		{0x1FA90, 0x1FABD, 1},
+		{0x1FABF, 0x1FAC5, 1},
+		{0x1FACE, 0x1FADB, 1},
+		{0x1FAE0, 0x1FAE8, 1},
+		{0x1FAF0, 0x1FAF8, 1},
+	},
+}
+
+const (
+	zeroWidthJoiner  = '\u200D'
+	textSelector     = '\uFE0E'
+	emojiSelector    = '\uFE0F'
+	combiningKeycap  = '\u20E3'
+	firstTag, endTag = '\U000E0020', '\U000E007F' // subdivision flags such as England's
+
+	firstModifier, lastModifier = '\U0001F3FB', '\U0001F3FF' // skin tones
+)
+
+// validEmoji accepts exactly one emoji as a user would see it: a keycap
+// such as 1️⃣, a flag, or emoji with optional variation selectors, skin
+// tones and tags joined into one ZWJ sequence such as 👨‍👩‍👧. Two emoji
+// side by side, digits, '#', letters, currency signs and other plain text
+// are rejected.
+func validEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiBytes || !utf8.ValidString(s) {
+		return false
+	}
+	if isKeycap(s) {
+		return true
+	}
+
+	rs := []rune(s)
+	for {
+		n := emojiElement(rs)
+		if n == 0 {
+			return false
+		}
+		rs = rs[n:]
+		if len(rs) == 0 {
+			return true
+		}
+		// Anything but a joiner starts a second emoji.
+		if rs[0] != zeroWidthJoiner {
+			return false
+		}
+		rs = rs[1:]
+	}
+}
+
+// emojiElement returns the number of runes at the start of rs that form one
+// element of a ZWJ sequence, or 0 if rs doesn't start with one. An element
+// is a pair of regional indicators, or an emoji followed by an optional
+// variation selector, an optional skin tone and an optional tag sequence.
+func emojiElement(rs []rune) int {
+	if len(rs) >= 2 && isRegionalIndicator(rs[0]) && isRegionalIndicator(rs[1]) {
+		return 2
+	}
+	if len(rs) == 0 || isRegionalIndicator(rs[0]) || !unicode.Is(emojiRunes, rs[0]) {
+		return 0
+	}
+
+	n := 1
+	if n < len(rs) && (rs[n] == textSelector || rs[n] == emojiSelector) {
+		n++
+	}
+	if n < len(rs) && firstModifier <= rs[n] && rs[n] <= lastModifier {
+		n++
+	}
+	if n < len(rs) && firstTag <= rs[n] && rs[n] < endTag {
+		for n < len(rs) && firstTag <= rs[n] && rs[n] < endTag {
+			n++
+		}
+		if n == len(rs) || rs[n] != endTag {
+			return 0
+		}
+		n++
+	}
+	return n
+}
+
+func isRegionalIndicator(r rune) bool {
+	return '\U0001F1E6' <= r && r <= '\U0001F1FF'
+}
+
+// isKeycap reports whether s is a keycap sequence: a digit, '#' or '*',
+// an optional emoji variation selector and U+20E3.
+func isKeycap(s string) bool {
+	if s == "" || !(s[0] >= '0' && s[0] <= '9' || s[0] == '#' || s[0] == '*') {
+		return false
+	}
+	rest := []rune(s[1:])
+	if len(rest) > 0 && rest[0] == emojiSelector {
+		rest = rest[1:]
+	}
+	return len(rest) == 1 && rest[0] == combiningKeycap
+}
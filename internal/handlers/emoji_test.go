@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"👍", true},
+		{"❤️", true},
+		{"❤", true},
+		{"👍🏽", true},
+		{"👨‍👩‍👧", true},
+		{"🇰🇿", true},
+		{"🏴\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", true},
+		{"1️⃣", true},
+		{"#⃣", true},
+		{"©", true},
+		{"👍\ufe0f", true},
+		{"🧑🏽\u200d💻", true},
+
+		{"🔥🔥", false},
+		{"👍🏽👍", false},
+		{"🇰🇿🇰🇿", false},
+		{"🇰🇿🇰", false},
+		{"🇰", false},
+		{"👍🏽🏽", false},
+		{"👍\u200d", false},
+		{"\u200d👍", false},
+		{"👍\u200d\u200d👍", false},
+		{"🏴\U000E0067\U000E0062", false},
+		{"1️⃣1️⃣", false},
+
+		{"", false},
+		{"1", false},
+		{"#", false},
+		{"*", false},
+		{"€", false},
+		{"a", false},
+		{"ж", false},
+		{"👍 ", false},
+		{"👍a", false},
+		{"\u200d", false},
+		{"\ufe0f", false},
+		{"1⃣⃣", false},
+		{"a⃣", false},
+		{strings.Repeat("👍", 9), false},
+		{"\xff", false},
+	}
+	for _, tt := range tests {
+		if got := validEmoji(tt.s); got != tt.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
@@ -2,27 +2,50 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/jackc/pgx/v5"
+
 	"aitu-connect/internal/middleware"
 	"aitu-connect/internal/repo"
+	"aitu-connect/internal/services"
 )
 
 type PostHandler struct {
-	posts *repo.PostRepo
+	posts           *repo.PostRepo
+	users           *repo.UserRepo
+	chat            *services.ChatService // for mention notifications
+	maxCommentDepth int
 }
 
-func NewPostHandler(posts *repo.PostRepo) *PostHandler {
-	return &PostHandler{posts: posts}
+// DefaultMaxCommentDepth is how deep replies may nest when not configured;
+// top-level comments have depth 0.
+const DefaultMaxCommentDepth = 3
+
+func NewPostHandler(posts *repo.PostRepo, users *repo.UserRepo, chat *services.ChatService, maxCommentDepth int) *PostHandler {
+	return &PostHandler{posts: posts, users: users, chat: chat, maxCommentDepth: maxCommentDepth}
 }
 
 type createPostReq struct {
+	Content       string   `json:"content"`
+	AttachmentIDs []string `json:"attachment_ids"`
+}
+
+type updatePostReq struct {
 	Content string `json:"content"`
 }
 
 type addCommentReq struct {
-	PostID  string `json:"post_id"`
+	PostID          string `json:"post_id"`
+	ParentCommentID string `json:"parent_comment_id"` // optional, for replies
+	Content         string `json:"content"`
+}
+
+type updateCommentReq struct {
 	Content string `json:"content"`
 }
 
@@ -39,20 +62,46 @@ func (h *PostHandler) CreatePost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Content == "" {
+	if req.Content == "" && len(req.AttachmentIDs) == 0 {
 		writeJSON(w, 400, map[string]string{"error": "content is required"})
 		return
 	}
 
-	id, err := h.posts.Create(r.Context(), userID, req.Content)
+	id, err := h.posts.Create(r.Context(), userID, req.Content, req.AttachmentIDs)
+	if errors.Is(err, repo.ErrBadAttachment) {
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
 
+	if post, err := h.posts.GetPost(r.Context(), id, userID); err != nil {
+		log.Println("Error loading post for mention notifications:", err)
+	} else {
+		h.chat.NotifyMentioned(r.Context(), nil, post.Mentions, services.PostMentionEvent(post))
+	}
+
 	writeJSON(w, 201, map[string]string{"id": id})
 }
 
+const (
+	defaultFeedLimit = 20
+	maxFeedLimit     = 50
+)
+
+// feedPage is a page of a cursor-paginated feed. NextCursor is empty on the last page.
+type feedPage struct {
+	Posts      []repo.Post `json:"posts"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// GetFeed returns a page of posts. Query params: limit (capped at
+// maxFeedLimit), cursor (the next_cursor of the previous page) and mode:
+//   - "all" (the default): every post, newest first
+//   - "following": the caller's posts and those of users they follow, newest first
+//   - "popular": ranked by engagement decayed with age
 func (h *PostHandler) GetFeed(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.UserIDFromContext(r.Context())
 	if !ok {
@@ -60,37 +109,274 @@ func (h *PostHandler) GetFeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
+	q := r.URL.Query()
+	limit := defaultFeedLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxFeedLimit)
+	}
+	cursor := q.Get("cursor")
 
-	limit := 20
-	offset := 0
+	// One extra row tells us whether there is another page.
+	var posts []repo.Post
+	var err error
+	switch q.Get("mode") {
+	case "", "all", "following":
+		var after *repo.FeedCursor
+		if cursor != "" {
+			if after, err = repo.ParseFeedCursor(cursor); err != nil {
+				writeJSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		if q.Get("mode") == "following" {
+			posts, err = h.posts.GetFollowingFeed(r.Context(), userID, after, limit+1)
+		} else {
+			posts, err = h.posts.GetFeed(r.Context(), userID, after, limit+1)
+		}
+	case "popular":
+		var after *repo.PopularCursor
+		if cursor != "" {
+			if after, err = repo.ParsePopularCursor(cursor); err != nil {
+				writeJSON(w, 400, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		posts, err = h.posts.GetPopularFeed(r.Context(), userID, after, limit+1)
+	default:
+		writeJSON(w, 400, map[string]string{"error": "mode must be all, following or popular"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
 
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	cursorOf := newestCursor
+	if q.Get("mode") == "popular" {
+		cursorOf = func(p repo.Post) string {
+			return repo.PopularCursor{Score: p.Score, ID: p.ID}.String()
 		}
 	}
-	if offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
+	writeJSON(w, 200, newFeedPage(posts, limit, cursorOf))
+}
+
+// newFeedPage builds a page from posts fetched with limit+1, taking the
+// cursor from the last post kept if there is another page.
+func newFeedPage(posts []repo.Post, limit int, cursorOf func(repo.Post) string) feedPage {
+	page := feedPage{Posts: posts}
+	if len(posts) > limit {
+		page.Posts = posts[:limit]
+		page.NextCursor = cursorOf(page.Posts[limit-1])
+	}
+	if page.Posts == nil {
+		page.Posts = []repo.Post{}
+	}
+	return page
+}
+
+// newestCursor is the cursor of feeds ordered newest first.
+func newestCursor(p repo.Post) string {
+	return repo.FeedCursor{CreatedAt: p.CreatedAt, ID: p.ID}.String()
+}
+
+// UpdatePost lets the author or a moderator change a post's content. The
+// previous version is kept as a revision.
+func (h *PostHandler) UpdatePost(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req updatePostReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+	if req.Content == "" {
+		writeJSON(w, 400, map[string]string{"error": "content is required"})
+		return
+	}
+
+	post, ok := h.loadChangeablePost(w, r, userID)
+	if !ok {
+		return
+	}
+
+	err := h.posts.UpdatePost(r.Context(), post.ID, userID, req.Content)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 409, map[string]string{"error": "post was deleted"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	updated, err := h.posts.GetPost(r.Context(), post.ID, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	h.chat.NotifyMentioned(r.Context(), post.Mentions, updated.Mentions, services.PostMentionEvent(updated))
+
+	writeJSON(w, 200, updated)
+}
+
+// DeletePost soft-deletes a post; see RestorePost.
+func (h *PostHandler) DeletePost(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	post, ok := h.loadChangeablePost(w, r, userID)
+	if !ok {
+		return
+	}
+
+	err := h.posts.DeletePost(r.Context(), post.ID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 409, map[string]string{"error": "post was deleted"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// RestorePost brings back a deleted post. Moderators only.
+func (h *PostHandler) RestorePost(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	moderator, err := h.isModerator(r, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if !moderator {
+		writeJSON(w, 403, map[string]string{"error": "only moderators can restore posts"})
+		return
+	}
+
+	postID := r.PathValue("id")
+	err = h.posts.RestorePost(r.Context(), postID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "deleted post not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	post, err := h.posts.GetPost(r.Context(), postID, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, post)
+}
+
+// GetRevisions lists earlier versions of a post. Revisions of a deleted
+// post are only shown to moderators.
+func (h *PostHandler) GetRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	post, err := h.posts.GetPost(r.Context(), r.PathValue("id"), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if post.IsDeleted {
+		moderator, err := h.isModerator(r, userID)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if !moderator {
+			writeJSON(w, 404, map[string]string{"error": "post not found"})
+			return
 		}
 	}
 
-	posts, err := h.posts.GetFeed(r.Context(), userID, limit, offset)
+	revisions, err := h.posts.GetRevisions(r.Context(), post.ID)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
 
-	if posts == nil {
-		posts = []repo.Post{}
+	if revisions == nil {
+		revisions = []repo.PostRevision{}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(posts)
+	writeJSON(w, 200, revisions)
 }
 
+// loadChangeablePost fetches the {id} post and checks that userID wrote it
+// or is a moderator. Deleted posts look missing to everyone else. On failure
+// it writes the error response and returns false.
+func (h *PostHandler) loadChangeablePost(w http.ResponseWriter, r *http.Request, userID string) (*repo.Post, bool) {
+	post, err := h.posts.GetPost(r.Context(), r.PathValue("id"), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	moderator := false
+	if post.UserID != userID || post.IsDeleted {
+		moderator, err = h.isModerator(r, userID)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return nil, false
+		}
+	}
+
+	switch {
+	case post.IsDeleted && !moderator:
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return nil, false
+	case post.IsDeleted:
+		writeJSON(w, 409, map[string]string{"error": "post was deleted"})
+		return nil, false
+	case post.UserID != userID && !moderator:
+		writeJSON(w, 403, map[string]string{"error": "only the author or a moderator can change this post"})
+		return nil, false
+	}
+	return post, true
+}
+
+func (h *PostHandler) isModerator(r *http.Request, userID string) (bool, error) {
+	user, err := h.users.GetByID(r.Context(), userID)
+	if err != nil {
+		return false, err
+	}
+	return user.IsModerator(), nil
+}
+
+// ToggleLike flips the caller's like on post_id. Passing liked=true or
+// liked=false sets it instead, which is safe to retry.
 func (h *PostHandler) ToggleLike(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.UserIDFromContext(r.Context())
 	if !ok {
@@ -104,13 +390,29 @@ func (h *PostHandler) ToggleLike(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isLiked, err := h.posts.ToggleLike(r.Context(), userID, postID)
+	var isLiked bool
+	var count int
+	var err error
+	switch liked := r.URL.Query().Get("liked"); liked {
+	case "":
+		isLiked, count, err = h.posts.ToggleLike(r.Context(), userID, postID)
+	case "true", "false":
+		isLiked = liked == "true"
+		count, err = h.posts.SetLike(r.Context(), userID, postID, isLiked)
+	default:
+		writeJSON(w, 400, map[string]string{"error": "liked must be true or false"})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return
+	}
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
 
-	writeJSON(w, 200, map[string]bool{"liked": isLiked})
+	writeJSON(w, 200, map[string]interface{}{"liked": isLiked, "likes_count": count})
 }
 
 func (h *PostHandler) AddComment(w http.ResponseWriter, r *http.Request) {
@@ -130,24 +432,105 @@ func (h *PostHandler) AddComment(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, 400, map[string]string{"error": "post_id and content are required"})
 		return
 	}
+	if !repo.IsUUID(req.PostID) {
+		writeJSON(w, 400, map[string]string{"error": "invalid post_id"})
+		return
+	}
+	if req.ParentCommentID != "" && !repo.IsUUID(req.ParentCommentID) {
+		writeJSON(w, 400, map[string]string{"error": "invalid parent_comment_id"})
+		return
+	}
+
+	comment := repo.NewComment{
+		PostID:   req.PostID,
+		UserID:   userID,
+		ParentID: req.ParentCommentID,
+		Content:  req.Content,
+	}
+	if req.ParentCommentID != "" {
+		parent, err := h.posts.GetComment(r.Context(), req.ParentCommentID, userID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && parent.PostID != req.PostID) {
+			writeJSON(w, 400, map[string]string{"error": "parent_comment_id must be a comment on the same post"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if parent.IsDeleted {
+			writeJSON(w, 409, map[string]string{"error": "comment was deleted"})
+			return
+		}
+		if parent.Depth >= h.maxCommentDepth {
+			writeJSON(w, 400, map[string]string{"error": fmt.Sprintf("replies can't be nested more than %d levels deep", h.maxCommentDepth)})
+			return
+		}
+		comment.Depth = parent.Depth + 1
+	}
 
-	id, err := h.posts.AddComment(r.Context(), userID, req.PostID, req.Content)
+	id, err := h.posts.AddComment(r.Context(), comment)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return
+	}
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
 
+	if c, err := h.posts.GetComment(r.Context(), id, userID); err != nil {
+		log.Println("Error loading comment for mention notifications:", err)
+	} else {
+		h.chat.NotifyMentioned(r.Context(), nil, c.Mentions, services.CommentMentionEvent(c))
+	}
+
 	writeJSON(w, 201, map[string]string{"id": id})
 }
 
+const (
+	defaultCommentLimit = 20
+	maxCommentLimit     = 100
+)
+
+// GetComments returns a page (limit, offset) of a post's top-level comments.
+// Replies are collapsed into reply_count; see GetReplies. Comments of a
+// deleted post are only shown to moderators.
 func (h *PostHandler) GetComments(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
 	postID := r.URL.Query().Get("post_id")
 	if postID == "" {
 		writeJSON(w, 400, map[string]string{"error": "post_id is required"})
 		return
 	}
 
-	comments, err := h.posts.GetComments(r.Context(), postID)
+	post, err := h.posts.GetPost(r.Context(), postID, userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "post not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if post.IsDeleted {
+		moderator, err := h.isModerator(r, userID)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if !moderator {
+			writeJSON(w, 404, map[string]string{"error": "post not found"})
+			return
+		}
+	}
+
+	limit, offset := pageParams(r, defaultCommentLimit, maxCommentLimit)
+	comments, err := h.posts.GetComments(r.Context(), post.ID, userID, limit, offset)
 	if err != nil {
 		writeJSON(w, 500, map[string]string{"error": err.Error()})
 		return
@@ -160,3 +543,205 @@ func (h *PostHandler) GetComments(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(comments)
 }
+
+// GetReplies returns a page (limit, offset) of the direct replies to the
+// {id} comment, each with its own reply_count.
+func (h *PostHandler) GetReplies(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	parent, _, ok := h.loadComment(w, r, userID)
+	if !ok {
+		return
+	}
+
+	limit, offset := pageParams(r, defaultCommentLimit, maxCommentLimit)
+	replies, err := h.posts.GetReplies(r.Context(), parent.ID, userID, limit, offset)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if replies == nil {
+		replies = []repo.Comment{}
+	}
+
+	writeJSON(w, 200, replies)
+}
+
+// pageParams reads limit and offset, capping limit at maxLimit.
+func pageParams(r *http.Request, defaultLimit, maxLimit int) (limit, offset int) {
+	limit = defaultLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxLimit)
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+	return limit, offset
+}
+
+// UpdateComment lets the author change their comment.
+func (h *PostHandler) UpdateComment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req updateCommentReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+	if req.Content == "" {
+		writeJSON(w, 400, map[string]string{"error": "content is required"})
+		return
+	}
+
+	comment, _, ok := h.loadComment(w, r, userID)
+	if !ok {
+		return
+	}
+	if comment.IsDeleted {
+		writeJSON(w, 409, map[string]string{"error": "comment was deleted"})
+		return
+	}
+	if comment.UserID != userID {
+		writeJSON(w, 403, map[string]string{"error": "only the author can edit this comment"})
+		return
+	}
+
+	_, err := h.posts.UpdateComment(r.Context(), comment.ID, req.Content)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 409, map[string]string{"error": "comment was deleted"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	updated, err := h.posts.GetComment(r.Context(), comment.ID, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	h.chat.NotifyMentioned(r.Context(), comment.Mentions, updated.Mentions, services.CommentMentionEvent(updated))
+
+	writeJSON(w, 200, updated)
+}
+
+// DeleteComment removes a comment, leaving a tombstone if it has replies.
+// Its author, the post's author and moderators may do so.
+func (h *PostHandler) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	comment, post, ok := h.loadComment(w, r, userID)
+	if !ok {
+		return
+	}
+	if comment.IsDeleted {
+		writeJSON(w, 404, map[string]string{"error": "comment not found"})
+		return
+	}
+	if comment.UserID != userID && post.UserID != userID {
+		moderator, err := h.isModerator(r, userID)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		if !moderator {
+			writeJSON(w, 403, map[string]string{"error": "only the comment or post author can delete this comment"})
+			return
+		}
+	}
+
+	err := h.posts.DeleteComment(r.Context(), comment.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "comment not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]string{"status": "ok"})
+}
+
+// ToggleCommentLike flips the caller's like on the {id} comment. Passing
+// liked=true or liked=false sets it instead, which is safe to retry.
+func (h *PostHandler) ToggleCommentLike(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	comment, _, ok := h.loadComment(w, r, userID)
+	if !ok {
+		return
+	}
+	if comment.IsDeleted {
+		writeJSON(w, 409, map[string]string{"error": "comment was deleted"})
+		return
+	}
+
+	var isLiked bool
+	var count int
+	var err error
+	switch liked := r.URL.Query().Get("liked"); liked {
+	case "":
+		isLiked, count, err = h.posts.ToggleCommentLike(r.Context(), userID, comment.ID)
+	case "true", "false":
+		isLiked = liked == "true"
+		count, err = h.posts.SetCommentLike(r.Context(), userID, comment.ID, isLiked)
+	default:
+		writeJSON(w, 400, map[string]string{"error": "liked must be true or false"})
+		return
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 409, map[string]string{"error": "comment was deleted"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]interface{}{"liked": isLiked, "likes_count": count})
+}
+
+// loadComment fetches the {id} comment and the post it belongs to. Comments
+// under a deleted post are reported as missing. On failure it writes the
+// error response and returns false.
+func (h *PostHandler) loadComment(w http.ResponseWriter, r *http.Request, userID string) (*repo.Comment, *repo.Post, bool) {
+	comment, err := h.posts.GetComment(r.Context(), r.PathValue("id"), userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "comment not found"})
+		return nil, nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, nil, false
+	}
+
+	post, err := h.posts.GetPost(r.Context(), comment.PostID, userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, nil, false
+	}
+	if post.IsDeleted {
+		writeJSON(w, 404, map[string]string{"error": "comment not found"})
+		return nil, nil, false
+	}
+	return comment, post, true
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"aitu-connect/internal/repo"
+)
+
+const (
+	// Each instance refreshes its sockets this often...
+	presenceHeartbeat = 30 * time.Second
+	// ...and sockets not refreshed for this long belong to a dead instance.
+	presenceTTL = 3 * presenceHeartbeat
+)
+
+// presenceTracker records this instance's sockets in repo.PresenceRepo,
+// which combines them with the sockets of every other instance, so a user
+// connected anywhere is online everywhere.
+type presenceTracker struct {
+	repo *repo.PresenceRepo
+
+	mu    sync.Mutex
+	conns map[*subscriber]string // socket -> presence connection id
+}
+
+func newPresenceTracker(presence *repo.PresenceRepo) *presenceTracker {
+	return &presenceTracker{repo: presence, conns: make(map[*subscriber]string)}
+}
+
+// connect registers a socket and reports the user's status afterwards.
+func (p *presenceTracker) connect(ctx context.Context, client *subscriber) (repo.PresenceChange, error) {
+	id, change, err := p.repo.Connect(ctx, client.userID)
+	if err != nil {
+		return change, err
+	}
+
+	p.mu.Lock()
+	p.conns[client] = id
+	p.mu.Unlock()
+	return change, nil
+}
+
+func (p *presenceTracker) disconnect(ctx context.Context, client *subscriber) (repo.PresenceChange, error) {
+	p.mu.Lock()
+	id, ok := p.conns[client]
+	delete(p.conns, client)
+	p.mu.Unlock()
+
+	if !ok {
+		return repo.PresenceChange{UserID: client.userID}, nil
+	}
+	return p.repo.Disconnect(ctx, client.userID, id)
+}
+
+func (p *presenceTracker) setAway(ctx context.Context, client *subscriber, away bool) (repo.PresenceChange, error) {
+	p.mu.Lock()
+	id, ok := p.conns[client]
+	p.mu.Unlock()
+
+	if !ok {
+		return repo.PresenceChange{UserID: client.userID}, nil
+	}
+	return p.repo.SetAway(ctx, client.userID, id, away)
+}
+
+// run keeps this instance's sockets alive and sweeps up those of dead
+// instances, passing the resulting status changes to onChange. It returns
+// when ctx is done.
+func (p *presenceTracker) run(ctx context.Context, onChange func(repo.PresenceChange)) {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		ids := make([]string, 0, len(p.conns))
+		for _, id := range p.conns {
+			ids = append(ids, id)
+		}
+		p.mu.Unlock()
+
+		if err := p.repo.Heartbeat(ctx, ids); err != nil && ctx.Err() == nil {
+			log.Println("Presence heartbeat error:", err)
+		}
+
+		changes, err := p.repo.ExpireStale(ctx, presenceTTL)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error expiring stale presence:", err)
+		}
+		for _, c := range changes {
+			onChange(c)
+		}
+	}
+}
@@ -1,21 +1,48 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
 
 	"aitu-connect/internal/middleware"
 	"aitu-connect/internal/repo"
+	"aitu-connect/internal/services"
 )
 
 type ProfileHandler struct {
-	users *repo.UserRepo
+	users   *repo.UserRepo
+	follows *repo.FollowRepo
+	auth    *services.AuthService
+}
+
+func NewProfileHandler(users *repo.UserRepo, follows *repo.FollowRepo, auth *services.AuthService) *ProfileHandler {
+	return &ProfileHandler{users: users, follows: follows, auth: auth}
+}
+
+type setUsernameReq struct {
+	Username string `json:"username"`
 }
 
-func NewProfileHandler(users *repo.UserRepo) *ProfileHandler {
-	return &ProfileHandler{users: users}
+// profileResp is a user with their follow counts. IsFollowedByMe is only
+// set when someone looks at another user's profile.
+type profileResp struct {
+	*repo.User
+	repo.FollowCounts
+	IsFollowedByMe *bool `json:"is_followed_by_me,omitempty"`
 }
 
+const (
+	defaultFollowLimit = 50
+	maxFollowLimit     = 100
+)
+
 func (h *ProfileHandler) Me(w http.ResponseWriter, r *http.Request) {
 	userID, ok := middleware.UserIDFromContext(r.Context())
 	if !ok {
@@ -29,9 +56,238 @@ func (h *ProfileHandler) Me(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	counts, err := h.follows.GetCounts(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Do NOT send password hash
 	user.PasswordHash = ""
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(profileResp{User: user, FollowCounts: counts})
+}
+
+// GetProfile returns the {id} user's public profile.
+func (h *ProfileHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	h.writeProfile(w, r, userID, user)
+}
+
+// GetProfileByUsername returns the public profile of the user with the
+// {username} handle, in any case. A handle its owner changed recently
+// redirects to their current one.
+func (h *ProfileHandler) GetProfileByUsername(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	username := r.PathValue("username")
+	id, current, err := h.users.GetIDByUsername(r.Context(), username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	if !strings.EqualFold(current, username) {
+		// Not permanent: the old handle is released after a while.
+		http.Redirect(w, r, "/api/usernames/"+url.PathEscape(current), http.StatusFound)
+		return
+	}
+
+	user, err := h.users.GetByID(r.Context(), id)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	user.PasswordHash = ""
+
+	h.writeProfile(w, r, userID, user)
+}
+
+// writeProfile sends user's profile as seen by viewerID. Only the user
+// themselves sees their email.
+func (h *ProfileHandler) writeProfile(w http.ResponseWriter, r *http.Request, viewerID string, user *repo.User) {
+	counts, err := h.follows.GetCounts(r.Context(), user.ID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := profileResp{User: user, FollowCounts: counts}
+	if user.ID != viewerID {
+		following, err := h.follows.IsFollowing(r.Context(), viewerID, user.ID)
+		if err != nil {
+			writeJSON(w, 500, map[string]string{"error": err.Error()})
+			return
+		}
+		resp.IsFollowedByMe = &following
+		user.Email = ""
+	}
+
+	writeJSON(w, 200, resp)
+}
+
+// SetUsername picks or changes the caller's username. Once set it can only
+// be changed every services.UsernameChangeCooldown, except for its case.
+func (h *ProfileHandler) SetUsername(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	var req setUsernameReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, 400, map[string]string{"error": "bad json"})
+		return
+	}
+
+	err := h.auth.SetUsername(r.Context(), userID, req.Username)
+	switch {
+	case errors.Is(err, services.ErrBadUsername), errors.Is(err, services.ErrReservedUsername):
+		writeJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, repo.ErrUsernameTaken):
+		writeJSON(w, 409, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, repo.ErrUsernameCooldown):
+		days := int(services.UsernameChangeCooldown.Hours() / 24)
+		writeJSON(w, 429, map[string]string{"error": fmt.Sprintf("username can only be changed once every %d days", days)})
+		return
+	case err != nil:
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	user, err := h.users.GetByID(r.Context(), userID)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+	user.PasswordHash = ""
+
+	writeJSON(w, 200, user)
+}
+
+func (h *ProfileHandler) Follow(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+	if user.ID == userID {
+		writeJSON(w, 400, map[string]string{"error": "you can't follow yourself"})
+		return
+	}
+
+	if _, err := h.follows.Follow(r.Context(), userID, user.ID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]bool{"following": true})
+}
+
+func (h *ProfileHandler) Unfollow(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	targetID := r.PathValue("id")
+	if !repo.IsUUID(targetID) {
+		writeJSON(w, 400, map[string]string{"error": "invalid user id"})
+		return
+	}
+
+	if _, err := h.follows.Unfollow(r.Context(), userID, targetID); err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, map[string]bool{"following": false})
+}
+
+// GetFollowers lists who follows the {id} user. Query params: limit, offset.
+func (h *ProfileHandler) GetFollowers(w http.ResponseWriter, r *http.Request) {
+	h.listFollows(w, r, h.follows.GetFollowers)
+}
+
+// GetFollowing lists who the {id} user follows. Query params: limit, offset.
+func (h *ProfileHandler) GetFollowing(w http.ResponseWriter, r *http.Request) {
+	h.listFollows(w, r, h.follows.GetFollowing)
+}
+
+type followLister func(ctx context.Context, userID, currentUserID string, limit, offset int) ([]repo.FollowUser, error)
+
+func (h *ProfileHandler) listFollows(w http.ResponseWriter, r *http.Request, list followLister) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	user, ok := h.loadUser(w, r)
+	if !ok {
+		return
+	}
+
+	limit, offset := pageParams(r, defaultFollowLimit, maxFollowLimit)
+	users, err := list(r.Context(), user.ID, userID, limit, offset)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if users == nil {
+		users = []repo.FollowUser{}
+	}
+
+	writeJSON(w, 200, users)
+}
+
+// loadUser fetches the {id} user without the password hash. On failure it
+// writes the error response and returns false.
+func (h *ProfileHandler) loadUser(w http.ResponseWriter, r *http.Request) (*repo.User, bool) {
+	id := r.PathValue("id")
+	if !repo.IsUUID(id) {
+		writeJSON(w, 400, map[string]string{"error": "invalid user id"})
+		return nil, false
+	}
+
+	user, err := h.users.GetByID(r.Context(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeJSON(w, 404, map[string]string{"error": "user not found"})
+		return nil, false
+	}
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+
+	user.PasswordHash = ""
+	return user, true
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"log"
+	"sync"
+)
+
+// Outgoing events buffered per connection before it is treated as a slow consumer.
+const sendQueueSize = 64
+
+// subscriber is one live connection receiving chat events, whatever the
+// transport. The registry and broker fan-out only ever see subscribers;
+// the WebSocket and SSE handlers each drain send in their own write loop.
+type subscriber struct {
+	userID string
+	send   chan []byte
+	done   chan struct{}
+	once   sync.Once
+	reason string
+
+	convs map[string]struct{} // guarded by ChatHandler.mu
+}
+
+func newSubscriber(userID string) *subscriber {
+	return &subscriber{
+		userID: userID,
+		send:   make(chan []byte, sendQueueSize),
+		done:   make(chan struct{}),
+		convs:  make(map[string]struct{}),
+	}
+}
+
+// enqueue queues an event without blocking. If the queue is full the
+// connection is closed, since it can no longer keep up with the conversation.
+func (s *subscriber) enqueue(payload []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.send <- payload:
+		return true
+	default:
+		log.Printf("Chat send queue full for user %s, disconnecting", s.userID)
+		s.close("slow consumer")
+		return false
+	}
+}
+
+// close asks the write loop to shut the connection down.
+func (s *subscriber) close(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		close(s.done)
+	})
+}
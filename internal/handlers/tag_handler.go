@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"aitu-connect/internal/hashtag"
+	"aitu-connect/internal/middleware"
+	"aitu-connect/internal/repo"
+)
+
+type TagHandler struct {
+	posts *repo.PostRepo
+}
+
+func NewTagHandler(posts *repo.PostRepo) *TagHandler {
+	return &TagHandler{posts: posts}
+}
+
+const (
+	defaultTrendingLimit = 10
+	maxTrendingLimit     = 50
+	// Trending tags are counted over posts from the last ?hours= hours.
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 7 * 24 * time.Hour
+)
+
+// GetTagPosts returns a page of posts tagged with {tag}, newest first. The
+// tag may be given in any case, with or without its '#'. Query params:
+// limit and cursor, as in GetFeed.
+func (h *TagHandler) GetTagPosts(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.UserIDFromContext(r.Context())
+	if !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	tag := hashtag.Normalize(r.PathValue("tag"))
+	if tag == "" {
+		writeJSON(w, 400, map[string]string{"error": "invalid tag"})
+		return
+	}
+
+	var after *repo.FeedCursor
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		if after, err = repo.ParseFeedCursor(cursor); err != nil {
+			writeJSON(w, 400, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
+	limit, _ := pageParams(r, defaultFeedLimit, maxFeedLimit)
+	posts, err := h.posts.GetTagFeed(r.Context(), userID, tag, after, limit+1)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, 200, newFeedPage(posts, limit, newestCursor))
+}
+
+// GetTrending returns the most used tags of recent posts. Query params:
+// limit and hours (the window, up to a week).
+func (h *TagHandler) GetTrending(w http.ResponseWriter, r *http.Request) {
+	if _, ok := middleware.UserIDFromContext(r.Context()); !ok {
+		writeJSON(w, 401, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	window := defaultTrendingWindow
+	if s := r.URL.Query().Get("hours"); s != "" {
+		hours, err := strconv.Atoi(s)
+		if err != nil || hours <= 0 {
+			writeJSON(w, 400, map[string]string{"error": "hours must be a positive number"})
+			return
+		}
+		window = min(time.Duration(hours)*time.Hour, maxTrendingWindow)
+	}
+
+	limit, _ := pageParams(r, defaultTrendingLimit, maxTrendingLimit)
+	tags, err := h.posts.GetTrendingTags(r.Context(), window, limit)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if tags == nil {
+		tags = []repo.TrendingTag{}
+	}
+
+	writeJSON(w, 200, tags)
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Clients are expected to repeat typing_start while the user keeps typing.
+// If they go quiet for longer than this, the server emits typing_stop itself.
+const typingTimeout = 6 * time.Second
+
+type typingKey struct {
+	convID string
+	userID string
+}
+
+// typingSession is the expiry timer of one user typing in one conversation.
+// gen changes on every start, so a timer that already fired when the
+// session was refreshed can tell that its callback is stale.
+type typingSession struct {
+	timer *time.Timer
+	gen   uint64
+}
+
+type typingTracker struct {
+	mu       sync.Mutex
+	sessions map[typingKey]typingSession
+	gen      uint64
+}
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{sessions: make(map[typingKey]typingSession)}
+}
+
+// start marks the user as typing and reports whether this is a new typing
+// session. onExpire runs if the session times out without an explicit stop
+// or another start.
+func (t *typingTracker) start(convID, userID string, onExpire func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{convID: convID, userID: userID}
+	old, active := t.sessions[key]
+	if active {
+		old.timer.Stop()
+	}
+
+	t.gen++
+	gen := t.gen
+	timer := time.AfterFunc(typingTimeout, func() {
+		t.mu.Lock()
+		current, ok := t.sessions[key]
+		expired := ok && current.gen == gen
+		if expired {
+			delete(t.sessions, key)
+		}
+		t.mu.Unlock()
+
+		if expired {
+			onExpire()
+		}
+	})
+	t.sessions[key] = typingSession{timer: timer, gen: gen}
+	return !active
+}
+
+// stop ends a typing session and reports whether one was active.
+func (t *typingTracker) stop(convID, userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := typingKey{convID: convID, userID: userID}
+	session, ok := t.sessions[key]
+	if !ok {
+		return false
+	}
+	session.timer.Stop()
+	delete(t.sessions, key)
+	return true
+}
+
+// stopUser ends every typing session of the user and returns the affected conversations.
+func (t *typingTracker) stopUser(userID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var convIDs []string
+	for key, session := range t.sessions {
+		if key.userID != userID {
+			continue
+		}
+		session.timer.Stop()
+		delete(t.sessions, key)
+		convIDs = append(convIDs, key.convID)
+	}
+	return convIDs
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer.
+	pongWait = 60 * time.Second
+	// Pings are sent with this period; it must be shorter than pongWait.
+	pingPeriod = pongWait * 9 / 10
+	// Largest frame accepted from the peer.
+	maxMessageSize = 8 * 1024
+)
+
+// wsClient owns one socket. Only writePump writes to conn; everyone else
+// hands frames over through the embedded subscriber so a slow peer never
+// blocks the caller.
+type wsClient struct {
+	*subscriber
+	conn *websocket.Conn
+}
+
+func newWSClient(conn *websocket.Conn, userID string) *wsClient {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	return &wsClient{
+		subscriber: newSubscriber(userID),
+		conn:       conn,
+	}
+}
+
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				log.Println("WebSocket write error:", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-c.done:
+			code := websocket.CloseNormalClosure
+			if c.reason != "" {
+				code = websocket.CloseTryAgainLater
+			}
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, c.reason),
+				time.Now().Add(writeWait))
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package hashtag finds #hashtags in post text. A tag is a run of letters,
+// digits, combining marks and underscores in any script, so #Алматы and
+// #қазақша work as well as #golang. Tags are compared in their normal form:
+// NFC and lower case.
+package hashtag
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxLength is the longest tag, in runes. Longer runs are not tags.
+const MaxLength = 64
+
+// Parse returns the distinct tags in text in normal form, in order of first
+// appearance. A '#' only starts a tag at the beginning of a word, so "C#",
+// "a#b" and URL fragments such as "/#top" are skipped, and a tag needs at
+// least one letter, so "#1" is not one.
+func Parse(text string) []string {
+	var tags []string
+	seen := make(map[string]struct{})
+
+	prev := rune(-1)
+	for i := 0; i < len(text); {
+		c, size := utf8.DecodeRuneInString(text[i:])
+		if c != '#' || !startsTag(prev) {
+			prev = c
+			i += size
+			continue
+		}
+
+		end := i + size
+		for end < len(text) {
+			r, n := utf8.DecodeRuneInString(text[end:])
+			if !isTagRune(r) {
+				break
+			}
+			end += n
+		}
+
+		if tag := Normalize(text[i+size : end]); tag != "" {
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+		prev, _ = utf8.DecodeLastRuneInString(text[:end])
+		i = end
+	}
+	return tags
+}
+
+// Normalize returns the normal form of a tag given with or without its
+// leading '#', or "" if it isn't a valid tag.
+func Normalize(tag string) string {
+	tag = norm.NFC.String(strings.ToLower(strings.TrimPrefix(tag, "#")))
+	if tag == "" || utf8.RuneCountInString(tag) > MaxLength {
+		return ""
+	}
+
+	hasLetter := false
+	for _, r := range tag {
+		if !isTagRune(r) {
+			return ""
+		}
+		if unicode.IsLetter(r) {
+			hasLetter = true
+		}
+	}
+	if !hasLetter {
+		return ""
+	}
+	return tag
+}
+
+func isTagRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// startsTag reports whether a '#' after prev (-1 at the start of the text)
+// begins a tag.
+func startsTag(prev rune) bool {
+	return prev == -1 || !(isTagRune(prev) || prev == '#' || prev == '/' || prev == '&')
+}
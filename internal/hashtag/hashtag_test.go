@@ -0,0 +1,67 @@
+package hashtag
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"alone", "#golang", []string{"golang"}},
+		{"in a sentence", "learning #Go today, #backend!", []string{"go", "backend"}},
+		{"deduplicated", "#Go #go #GO", []string{"go"}},
+		{"underscore", "#machine_learning.", []string{"machine_learning"}},
+		{"digits with a letter", "#2024год", []string{"2024год"}},
+		{"digits only", "#1 and #2024", nil},
+		{"language name", "C# and F# are fine", nil},
+		{"inside a word", "a#b", nil},
+		{"url fragment", "https://aitu.edu.kz/#top", nil},
+		{"html entity", "it&#39;s", nil},
+		{"double hash", "##tag", nil},
+		{"bare hash", "# heading", nil},
+
+		{"cyrillic", "#Алматы", []string{"алматы"}},
+		{"kazakh case folding", "#ҚАЗАҚША and #қазақша", []string{"қазақша"}},
+		{"kazakh letters", "#Өскемен #Үміт", []string{"өскемен", "үміт"}},
+
+		// e + combining acute and precomposed é are the same tag.
+		{"nfc", "#cafe\u0301 #caf\u00e9", []string{"caf\u00e9"}},
+
+		{"max length", "#" + strings.Repeat("a", MaxLength), []string{strings.Repeat("a", MaxLength)}},
+		{"too long", "#" + strings.Repeat("a", MaxLength+1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("Parse(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		tag, want string
+	}{
+		{"#Go", "go"},
+		{"go", "go"},
+		{"#ҚАЗАҚША", "қазақша"},
+		{"cafe\u0301", "caf\u00e9"},
+		{"", ""},
+		{"#", ""},
+		{"123", ""},
+		{"go!", ""},
+		{"two words", ""},
+		{strings.Repeat("я", MaxLength+1), ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.tag); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func fill(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestBlurhash(t *testing.T) {
+	split := fill(8, 6, color.Black)
+	for y := 0; y < 6; y++ {
+		for x := 4; x < 8; x++ {
+			split.Set(x, y, color.White)
+		}
+	}
+
+	// The DC part (characters 3-6) is the average colour: 0xFF0000 is
+	// "TI:j" and 0xFFFFFF "TSUA" in base 83. The cosine basis is sampled at
+	// pixel edges as in the reference encoder, so even flat images have
+	// some AC energy in the odd components.
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"red", fill(8, 6, color.NRGBA{255, 0, 0, 255}), "LsTI:j]9fQ]9|csUfQsUfQfQfQfQ"},
+		{"white", fill(8, 6, color.White), "LsTSUA_3fQ_3~qt7fQt7fQfQfQfQ"},
+		{"offset bounds", fill(12, 9, color.White).SubImage(image.Rect(2, 2, 10, 8)), "LsTSUA_3fQ_3~qt7fQt7fQfQfQfQ"},
+		{"black and white", split, "L~Lqe900D%?b%MM{Rjt7fQfQfQfQ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Blurhash(tt.img, 4, 3); got != tt.want {
+				t.Errorf("Blurhash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlurhashComponents(t *testing.T) {
+	img := fill(4, 4, color.White)
+	for _, c := range []struct{ x, y, length int }{
+		{1, 1, 6},
+		{4, 3, 6 + 2*11},
+		{9, 9, 6 + 2*80},
+	} {
+		got := Blurhash(img, c.x, c.y)
+		if len(got) != c.length {
+			t.Errorf("Blurhash(%dx%d) has length %d, want %d", c.x, c.y, len(got), c.length)
+		}
+		if want := base83[(c.x-1)+(c.y-1)*9]; got[0] != want {
+			t.Errorf("Blurhash(%dx%d) starts with %q, want %q", c.x, c.y, got[0], want)
+		}
+	}
+}
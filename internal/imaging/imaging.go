@@ -0,0 +1,142 @@
+// Package imaging normalises uploaded photos: it applies and strips EXIF
+// metadata, produces thumbnails and computes a blurhash placeholder. Only
+// pure-Go decoders are used so the server needs no system libraries.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Refuse to decode anything larger than this to keep memory bounded.
+const maxPixels = 50_000_000
+
+const jpegQuality = 85
+
+var ErrTooLarge = errors.New("image dimensions too large")
+
+type Result struct {
+	// Original is the re-encoded full-size image without any metadata.
+	Original    []byte
+	ContentType string
+	Width       int
+	Height      int
+	Blurhash    string
+	Thumbnails  []Thumbnail
+}
+
+type Thumbnail struct {
+	Size        int // longest side the thumbnail was fitted into
+	Width       int
+	Height      int
+	Data        []byte
+	ContentType string
+}
+
+// Process decodes a JPEG, PNG or WebP image and returns a clean copy plus
+// thumbnails for each size smaller than the image itself.
+func Process(data []byte, sizes []int) (*Result, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	// Re-encoding drops EXIF, XMP and every other metadata block.
+	original, contentType, err := encode(img)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	res := &Result{
+		Original:    original,
+		ContentType: contentType,
+		Width:       b.Dx(),
+		Height:      b.Dy(),
+		Blurhash:    Blurhash(fit(img, 32), 4, 3),
+	}
+
+	for _, size := range sizes {
+		if size >= b.Dx() && size >= b.Dy() {
+			continue
+		}
+		thumb := fit(img, size)
+		data, ct, err := encode(thumb)
+		if err != nil {
+			return nil, err
+		}
+		tb := thumb.Bounds()
+		res.Thumbnails = append(res.Thumbnails, Thumbnail{
+			Size:        size,
+			Width:       tb.Dx(),
+			Height:      tb.Dy(),
+			Data:        data,
+			ContentType: ct,
+		})
+	}
+
+	return res, nil
+}
+
+// fit scales img down so its longest side is at most size.
+func fit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// encode writes JPEG for opaque images and PNG when transparency must survive.
+func encode(img image.Image) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if isOpaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "image/jpeg", nil
+	}
+
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "image/png", nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var red = color.NRGBA{255, 0, 0, 255}
+
+// halfRed is a w x h image whose left half is red and right half blue.
+func halfRed(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, red)
+			} else {
+				img.Set(x, y, color.NRGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r>>8 > 200 && g>>8 < 60 && b>>8 < 60
+}
+
+func TestProcessAppliesOrientation(t *testing.T) {
+	jpg := encodeJPEG(t, halfRed(40, 20))
+
+	tests := []struct {
+		orientation int
+		// Where the left (red) half of the stored image ends up.
+		redAt, blueAt image.Point
+	}{
+		{1, image.Pt(5, 10), image.Pt(35, 10)},
+		{6, image.Pt(10, 5), image.Pt(10, 35)}, // turned clockwise: red on top
+		{8, image.Pt(10, 35), image.Pt(10, 5)}, // turned counter-clockwise: red at the bottom
+		{3, image.Pt(35, 10), image.Pt(5, 10)}, // upside down: red on the right
+	}
+	for _, tt := range tests {
+		data := withExif(jpg, tiffWithOrientation(binary.BigEndian, uint16(tt.orientation)))
+		res, err := Process(data, nil)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", tt.orientation, err)
+		}
+
+		wantW, wantH := 40, 20
+		if tt.orientation >= 5 {
+			wantW, wantH = 20, 40
+		}
+		if res.Width != wantW || res.Height != wantH {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, res.Width, res.Height, wantW, wantH)
+		}
+
+		out := decode(t, res.Original)
+		if b := out.Bounds(); b.Dx() != wantW || b.Dy() != wantH {
+			t.Errorf("orientation %d: stored image is %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), wantW, wantH)
+			continue
+		}
+		if !isRed(out.At(tt.redAt.X, tt.redAt.Y)) || isRed(out.At(tt.blueAt.X, tt.blueAt.Y)) {
+			t.Errorf("orientation %d: red half is not at %v", tt.orientation, tt.redAt)
+		}
+	}
+}
+
+func TestProcessStripsExif(t *testing.T) {
+	data := withExif(encodeJPEG(t, halfRed(40, 20)), tiffWithOrientation(binary.LittleEndian, 6))
+	if jpegOrientation(data) != 6 {
+		t.Fatal("test image has no EXIF orientation")
+	}
+
+	res, err := Process(data, []int{16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ContentType != "image/jpeg" {
+		t.Fatalf("ContentType = %q, want image/jpeg", res.ContentType)
+	}
+
+	outputs := [][]byte{res.Original}
+	for _, th := range res.Thumbnails {
+		outputs = append(outputs, th.Data)
+	}
+	for i, out := range outputs {
+		if bytes.Contains(out, []byte("Exif\x00\x00")) {
+			t.Errorf("output %d still contains an EXIF block", i)
+		}
+		if jpegOrientation(out) != 1 {
+			t.Errorf("output %d still carries an orientation", i)
+		}
+	}
+}
+
+func TestProcessThumbnails(t *testing.T) {
+	data := encodePNG(t, halfRed(1200, 600))
+	sizes := []int{160, 480, 1080, 1200, 2000}
+
+	res, err := Process(data, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes at or above the image's own are skipped.
+	if len(res.Thumbnails) != 3 {
+		t.Fatalf("got %d thumbnails, want 3", len(res.Thumbnails))
+	}
+	for i, th := range res.Thumbnails {
+		if th.Size != sizes[i] {
+			t.Errorf("thumbnail %d: Size = %d, want %d", i, th.Size, sizes[i])
+		}
+		if th.Width != th.Size || th.Height != th.Size/2 {
+			t.Errorf("thumbnail %d: %dx%d, want %dx%d", i, th.Width, th.Height, th.Size, th.Size/2)
+		}
+
+		b := decode(t, th.Data).Bounds()
+		if b.Dx() != th.Width || b.Dy() != th.Height {
+			t.Errorf("thumbnail %d: encoded as %dx%d, recorded as %dx%d", i, b.Dx(), b.Dy(), th.Width, th.Height)
+		}
+		if max(b.Dx(), b.Dy()) > th.Size {
+			t.Errorf("thumbnail %d: %dx%d exceeds %d", i, b.Dx(), b.Dy(), th.Size)
+		}
+	}
+}
+
+func TestProcessPortraitThumbnail(t *testing.T) {
+	res, err := Process(encodePNG(t, halfRed(300, 900)), []int{160})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Thumbnails) != 1 {
+		t.Fatalf("got %d thumbnails, want 1", len(res.Thumbnails))
+	}
+	if th := res.Thumbnails[0]; th.Width != 53 || th.Height != 160 {
+		t.Errorf("thumbnail is %dx%d, want 53x160", th.Width, th.Height)
+	}
+}
+
+func TestProcessContentType(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	transparent.Set(1, 1, red)
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"opaque png", encodePNG(t, halfRed(8, 8)), "image/jpeg"},
+		{"transparent png", encodePNG(t, transparent), "image/png"},
+		{"jpeg", encodeJPEG(t, halfRed(8, 8)), "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Process(tt.data, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ContentType != tt.want {
+				t.Errorf("ContentType = %q, want %q", res.ContentType, tt.want)
+			}
+			if res.Blurhash == "" {
+				t.Error("no blurhash")
+			}
+		})
+	}
+}
+
+func TestProcessRejects(t *testing.T) {
+	// Claim 10000x10000 pixels in the header without storing them.
+	huge := encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	ihdr := huge[8+8 : 8+8+13] // after the signature and the chunk length and type
+	binary.BigEndian.PutUint32(ihdr[0:], 10000)
+	binary.BigEndian.PutUint32(ihdr[4:], 10000)
+	binary.BigEndian.PutUint32(huge[8+8+13:], crc32.ChecksumIEEE(huge[8+4:8+8+13]))
+
+	if _, err := Process(huge, nil); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Process(10000x10000) = %v, want ErrTooLarge", err)
+	}
+	if _, err := Process([]byte("not an image"), nil); err == nil {
+		t.Error("Process(garbage) succeeded")
+	}
+}
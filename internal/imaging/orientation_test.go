@@ -0,0 +1,141 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// tiffWithOrientation builds a TIFF header with one IFD holding the
+// orientation tag, as found in the EXIF block of a JPEG.
+func tiffWithOrientation(order binary.ByteOrder, orientation uint16) []byte {
+	b := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8) // first IFD right after the header
+	order.PutUint16(b[8:], 1) // one entry
+	order.PutUint16(b[10:], 0x0112)
+	order.PutUint16(b[12:], 3) // SHORT
+	order.PutUint32(b[14:], 1)
+	order.PutUint16(b[18:], orientation)
+	return b
+}
+
+// withExif inserts an APP1 EXIF segment right after the SOI marker of a JPEG.
+func withExif(jpg, tiff []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(payload)))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"big endian", tiffWithOrientation(binary.BigEndian, 6), 6},
+		{"little endian", tiffWithOrientation(binary.LittleEndian, 8), 8},
+		{"upright", tiffWithOrientation(binary.BigEndian, 1), 1},
+		{"out of range", tiffWithOrientation(binary.BigEndian, 9), 1},
+		{"zero", tiffWithOrientation(binary.LittleEndian, 0), 1},
+		{"bad byte order", append([]byte("XX"), tiffWithOrientation(binary.BigEndian, 6)[2:]...), 1},
+		{"truncated entry", tiffWithOrientation(binary.BigEndian, 6)[:16], 1},
+		{"too short", []byte("MM\x00"), 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.tiff); got != tt.want {
+				t.Errorf("exifOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	other := tiffWithOrientation(binary.BigEndian, 6)
+	binary.BigEndian.PutUint16(other[10:], 0x0110) // Model, not Orientation
+	if got := exifOrientation(other); got != 1 {
+		t.Errorf("exifOrientation() without the tag = %d, want 1", got)
+	}
+}
+
+func TestJpegOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", plain, 1},
+		{"rotated", withExif(plain, tiffWithOrientation(binary.BigEndian, 6)), 6},
+		{"little endian", withExif(plain, tiffWithOrientation(binary.LittleEndian, 3)), 3},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n"), 1},
+		{"truncated segment", withExif(plain, tiffWithOrientation(binary.BigEndian, 6))[:20], 1},
+		{"empty", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegOrientation(tt.data); got != tt.want {
+				t.Errorf("jpegOrientation() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image whose pixels are numbered 1-6 row by row:
+	//	1 2 3
+	//	4 5 6
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i + 1)
+	}
+
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{1, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+		{2, [][]uint8{{3, 2, 1}, {6, 5, 4}}},
+		{3, [][]uint8{{6, 5, 4}, {3, 2, 1}}},
+		{4, [][]uint8{{4, 5, 6}, {1, 2, 3}}},
+		{5, [][]uint8{{1, 4}, {2, 5}, {3, 6}}},
+		{6, [][]uint8{{4, 1}, {5, 2}, {6, 3}}},
+		{7, [][]uint8{{6, 3}, {5, 2}, {4, 1}}},
+		{8, [][]uint8{{3, 6}, {2, 5}, {1, 4}}},
+		{9, [][]uint8{{1, 2, 3}, {4, 5, 6}}},
+	}
+	for _, tt := range tests {
+		got := applyOrientation(src, tt.orientation)
+		b := got.Bounds()
+		if b.Dx() != len(tt.want[0]) || b.Dy() != len(tt.want) {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d",
+				tt.orientation, b.Dx(), b.Dy(), len(tt.want[0]), len(tt.want))
+			continue
+		}
+		for y, row := range tt.want {
+			for x, want := range row {
+				if v := color.GrayModel.Convert(got.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y; v != want {
+					t.Errorf("orientation %d: pixel (%d,%d) = %d, want %d", tt.orientation, x, y, v, want)
+				}
+			}
+		}
+	}
+}
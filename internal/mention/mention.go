@@ -0,0 +1,84 @@
+// Package mention finds @handle references in posts, comments and chat
+// messages. Positions are reported in UTF-16 code units, the way JavaScript
+// indexes strings, so clients can cut the content without converting.
+package mention
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest handle, in characters. Longer runs are not mentions.
+const MaxLength = 32
+
+// Ref is one @handle in a text.
+type Ref struct {
+	// Handle in lower case, without the '@'.
+	Handle string
+	// Offset and Length cover the '@' and the handle.
+	Offset int
+	Length int
+}
+
+// Parse returns every @handle in text, in order. A handle is ASCII letters,
+// digits, '_' and '.', not ending in a dot so that "@bob." at the end of a
+// sentence finds bob. An '@' inside a word, as in an email address, doesn't
+// start a mention.
+func Parse(text string) []Ref {
+	var refs []Ref
+
+	prev := rune(-1)
+	pos := 0 // in UTF-16 units
+	for i := 0; i < len(text); {
+		c, size := utf8.DecodeRuneInString(text[i:])
+		if c != '@' || !startsMention(prev) {
+			prev = c
+			pos += utf16Len(c)
+			i += size
+			continue
+		}
+
+		end := i + size
+		for end < len(text) && isHandleByte(text[end]) {
+			end++
+		}
+		handle := strings.TrimRight(text[i+size:end], ".")
+		end = i + size + len(handle)
+
+		if handle != "" && len(handle) <= MaxLength {
+			refs = append(refs, Ref{
+				Handle: strings.ToLower(handle),
+				Offset: pos,
+				Length: 1 + len(handle),
+			})
+		}
+
+		// Handles are ASCII, one UTF-16 unit per byte.
+		pos += end - i
+		prev, _ = utf8.DecodeLastRuneInString(text[:end])
+		i = end
+	}
+	return refs
+}
+
+func isHandleByte(b byte) bool {
+	return b == '_' || b == '.' ||
+		'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// startsMention reports whether an '@' after prev (-1 at the start of the
+// text) begins a mention.
+func startsMention(prev rune) bool {
+	return prev == -1 ||
+		!(unicode.IsLetter(prev) || unicode.IsDigit(prev) || unicode.IsMark(prev) ||
+			prev == '_' || prev == '.' || prev == '@' || prev == '/')
+}
+
+func utf16Len(r rune) int {
+	if n := utf16.RuneLen(r); n > 0 {
+		return n
+	}
+	return 1 // invalid UTF-8 decodes to U+FFFD
+}
@@ -0,0 +1,46 @@
+package mention
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Ref
+	}{
+		{"alone", "@bob", []Ref{{"bob", 0, 4}}},
+		{"lower-cased", "hi @BoB", []Ref{{"bob", 3, 4}}},
+		{"several", "@bob_1 and @carol", []Ref{{"bob_1", 0, 6}, {"carol", 11, 6}}},
+		{"in brackets", "(@amy)", []Ref{{"amy", 1, 4}}},
+		{"dots inside", "@a.b.c", []Ref{{"a.b.c", 0, 6}}},
+		{"trailing dot", "thanks @bob.", []Ref{{"bob", 7, 4}}},
+		{"trailing dots", "@bob... ok", []Ref{{"bob", 0, 4}}},
+		{"only dots", "@...", nil},
+		{"bare at", "@ bob", nil},
+		{"email", "mail bob@example.com", nil},
+		{"after mention", "@@bob", nil},
+		{"url path", "https://x.kz/@bob", nil},
+		{"inside a word", "x@bob @amy", []Ref{{"amy", 6, 4}}},
+
+		// Offsets count UTF-16 units: astral emoji take two, BMP letters one.
+		{"after astral emoji", "😀 @amy", []Ref{{"amy", 3, 4}}},
+		{"right after astral emoji", "😀😀@amy", []Ref{{"amy", 4, 4}}},
+		{"after cyrillic", "Привет @amy", []Ref{{"amy", 7, 4}}},
+		{"emoji between", "@a 🎉🎉 @b", []Ref{{"a", 0, 2}, {"b", 8, 2}}},
+		{"after cyrillic letter", "ж@amy", nil},
+
+		{"max length", "@" + strings.Repeat("a", MaxLength), []Ref{{strings.Repeat("a", MaxLength), 0, MaxLength + 1}}},
+		{"too long", "@" + strings.Repeat("a", MaxLength+1), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Parse(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("Parse(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
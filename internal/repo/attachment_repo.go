@@ -0,0 +1,262 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrBadAttachment means an attachment id doesn't name an unused upload of the sender.
+var ErrBadAttachment = errors.New("attachment_ids must be your own attachments not yet used elsewhere")
+
+type Attachment struct {
+	ID          string      `json:"id"`
+	UploaderID  string      `json:"uploader_id"`
+	StorageKey  string      `json:"-"`
+	Filename    string      `json:"filename"`
+	ContentType string      `json:"content_type"`
+	SizeBytes   int64       `json:"size_bytes"`
+	CreatedAt   time.Time   `json:"created_at"`
+	ImageStatus string      `json:"image_status,omitempty"`
+	Width       int         `json:"width,omitempty"`
+	Height      int         `json:"height,omitempty"`
+	Blurhash    string      `json:"blurhash,omitempty"`
+	Thumbnails  []Thumbnail `json:"thumbnails,omitempty"`
+}
+
+type Thumbnail struct {
+	Size        int    `json:"size"`
+	StorageKey  string `json:"-"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+const (
+	ImagePending    = "pending"
+	ImageProcessing = "processing"
+	ImageDone       = "done"
+	ImageFailed     = "failed"
+)
+
+// attachmentColumns selects everything scanAttachment expects from "attachments a".
+const attachmentColumns = `
+	a.id::text, a.uploader_id::text, a.storage_key, a.filename, a.content_type,
+	a.size_bytes, a.created_at, COALESCE(a.image_status, ''),
+	COALESCE(a.width, 0), COALESCE(a.height, 0), COALESCE(a.blurhash, ''),
+	(SELECT COALESCE(json_agg(json_build_object(
+			'size', t.size, 'storage_key', t.storage_key, 'content_type', t.content_type,
+			'size_bytes', t.size_bytes, 'width', t.width, 'height', t.height
+		) ORDER BY t.size), '[]')
+	 FROM attachment_thumbnails t WHERE t.attachment_id = a.id)
+`
+
+// thumbnailRow mirrors Thumbnail but decodes storage_key from the json_agg above.
+type thumbnailRow struct {
+	Size        int    `json:"size"`
+	StorageKey  string `json:"storage_key"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+func scanAttachment(row pgx.Row, extra ...any) (Attachment, error) {
+	var a Attachment
+	var thumbs []thumbnailRow
+	dest := append(extra, &a.ID, &a.UploaderID, &a.StorageKey, &a.Filename, &a.ContentType,
+		&a.SizeBytes, &a.CreatedAt, &a.ImageStatus, &a.Width, &a.Height, &a.Blurhash, &thumbs)
+	if err := row.Scan(dest...); err != nil {
+		return a, err
+	}
+	for _, t := range thumbs {
+		a.Thumbnails = append(a.Thumbnails, Thumbnail(t))
+	}
+	return a, nil
+}
+
+type AttachmentRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewAttachmentRepo(db *pgxpool.Pool) *AttachmentRepo {
+	return &AttachmentRepo{db: db}
+}
+
+// Create stores a new attachment. Set ImageStatus to ImagePending to queue it for the image pipeline.
+func (r *AttachmentRepo) Create(ctx context.Context, a *Attachment) error {
+	return r.db.QueryRow(ctx, `
+		INSERT INTO attachments (uploader_id, storage_key, filename, content_type, size_bytes, image_status)
+		VALUES ($1::uuid, $2, $3, $4, $5, NULLIF($6, ''))
+		RETURNING id::text, created_at
+	`, a.UploaderID, a.StorageKey, a.Filename, a.ContentType, a.SizeBytes, a.ImageStatus).Scan(&a.ID, &a.CreatedAt)
+}
+
+func (r *AttachmentRepo) GetByID(ctx context.Context, id string) (*Attachment, error) {
+	a, err := scanAttachment(r.db.QueryRow(ctx, `
+		SELECT `+attachmentColumns+`
+		FROM attachments a
+		WHERE a.id = $1::uuid
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// linkAttachments attaches the uploader's unused attachments to the owner
+// (column is post_id or message_id), in the transaction that creates it.
+// It fails with ErrBadAttachment if any id belongs to someone else or is
+// already in use, so the caller's transaction can be rolled back.
+func linkAttachments(ctx context.Context, tx pgx.Tx, column, ownerID, uploaderID string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		if !IsUUID(id) {
+			return ErrBadAttachment
+		}
+	}
+	ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE attachments
+		SET `+column+` = $1::uuid
+		WHERE id = ANY($2::uuid[])
+		  AND uploader_id = $3::uuid
+		  AND message_id IS NULL
+		  AND post_id IS NULL
+	`, ownerID, ids, uploaderID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != int64(len(ids)) {
+		return ErrBadAttachment
+	}
+	return nil
+}
+
+// CanAccess reports whether userID may download the attachment: uploaders
+// always can, otherwise it depends on the message's conversation membership
+// or on the post being visible.
+func (r *AttachmentRepo) CanAccess(ctx context.Context, id, userID string) (bool, error) {
+	var ok bool
+	err := r.db.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1
+			FROM attachments a
+			LEFT JOIN messages m ON m.id = a.message_id AND m.deleted_at IS NULL
+			LEFT JOIN conversation_participants cp
+				ON cp.conversation_id = m.conversation_id AND cp.user_id = $2::uuid
+			LEFT JOIN posts p ON p.id = a.post_id AND p.deleted_at IS NULL
+			WHERE a.id = $1::uuid
+			  AND (a.uploader_id = $2::uuid OR cp.id IS NOT NULL OR p.id IS NOT NULL)
+		)
+	`, id, userID).Scan(&ok)
+	return ok, err
+}
+
+// imageJobTimeout is how long a worker may hold a job before another one retries it.
+const imageJobTimeout = 10 * time.Minute
+
+// ClaimImageJob takes the oldest pending image for processing. It returns
+// pgx.ErrNoRows when there is nothing to do. SKIP LOCKED lets several
+// instances run workers side by side.
+func (r *AttachmentRepo) ClaimImageJob(ctx context.Context) (*Attachment, error) {
+	a, err := scanAttachment(r.db.QueryRow(ctx, `
+		UPDATE attachments a
+		SET image_status = 'processing',
+		    image_attempts = image_attempts + 1,
+		    image_claimed_at = NOW()
+		WHERE a.id = (
+			SELECT id FROM attachments
+			WHERE image_status = 'pending'
+			   OR (image_status = 'processing' AND image_claimed_at < NOW() - make_interval(secs => $1))
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+attachmentColumns, imageJobTimeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CompleteImageJob records the processed image, its new filename and its thumbnails.
+// The original object has already been overwritten in storage by then.
+func (r *AttachmentRepo) CompleteImageJob(ctx context.Context, a *Attachment) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE attachments
+		SET image_status = 'done', image_error = NULL,
+		    content_type = $2, size_bytes = $3, width = $4, height = $5, blurhash = $6, filename = $7
+		WHERE id = $1::uuid
+	`, a.ID, a.ContentType, a.SizeBytes, a.Width, a.Height, a.Blurhash, a.Filename)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM attachment_thumbnails WHERE attachment_id = $1::uuid`, a.ID)
+	if err != nil {
+		return err
+	}
+	for _, t := range a.Thumbnails {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO attachment_thumbnails (attachment_id, size, storage_key, content_type, size_bytes, width, height)
+			VALUES ($1::uuid, $2, $3, $4, $5, $6, $7)
+		`, a.ID, t.Size, t.StorageKey, t.ContentType, t.SizeBytes, t.Width, t.Height)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// FailImageJob puts the job back in the queue, or marks it failed once it has been tried maxAttempts times.
+func (r *AttachmentRepo) FailImageJob(ctx context.Context, id, reason string, maxAttempts int) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE attachments
+		SET image_status = CASE WHEN image_attempts >= $3 THEN 'failed' ELSE 'pending' END,
+		    image_error = $2
+		WHERE id = $1::uuid
+	`, id, reason, maxAttempts)
+	return err
+}
+
+// loadAttachments returns the attachments of each owner, keyed by owner ID.
+// column is message_id or post_id.
+func loadAttachments(ctx context.Context, db *pgxpool.Pool, column string, ownerIDs []string) (map[string][]Attachment, error) {
+	rows, err := db.Query(ctx, `
+		SELECT a.`+column+`::text, `+attachmentColumns+`
+		FROM attachments a
+		WHERE a.`+column+` = ANY($1::uuid[])
+		ORDER BY a.created_at
+	`, ownerIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byOwner := make(map[string][]Attachment)
+	for rows.Next() {
+		var ownerID string
+		a, err := scanAttachment(rows, &ownerID)
+		if err != nil {
+			return nil, err
+		}
+		byOwner[ownerID] = append(byOwner[ownerID], a)
+	}
+	return byOwner, rows.Err()
+}
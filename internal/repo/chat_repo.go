@@ -2,11 +2,20 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrReactionLimit = errors.New("too many different reactions on this message")
+	ErrPinLimit      = errors.New("too many pinned messages in this conversation")
+)
+
+const RoleAdmin = "admin"
+
 type Conversation struct {
 	ID        string    `json:"id"`
 	IsGroup   bool      `json:"is_group"`
@@ -18,16 +27,66 @@ type Conversation struct {
 	OtherUserLastName  string     `json:"other_user_last_name,omitempty"`
 	LastMessage        string     `json:"last_message,omitempty"`
 	LastMessageTime    *time.Time `json:"last_message_time,omitempty"`
+	// Personal settings of the requesting user
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	IsArchived bool       `json:"is_archived"`
+	IsPinned   bool       `json:"is_pinned"`
+}
+
+// ConversationSettings holds the changes to apply; nil fields are left as they are.
+// A zero MutedUntil unmutes.
+type ConversationSettings struct {
+	MutedUntil *time.Time
+	Archived   *bool
+	Pinned     *bool
 }
 
 type Message struct {
-	ID              string    `json:"id"`
-	ConversationID  string    `json:"conversation_id"`
-	UserID          string    `json:"user_id"`
-	Content         string    `json:"content"`
-	CreatedAt       time.Time `json:"created_at"`
-	AuthorFirstName string    `json:"author_first_name"`
-	AuthorLastName  string    `json:"author_last_name"`
+	ID              string        `json:"id"`
+	ConversationID  string        `json:"conversation_id"`
+	UserID          string        `json:"user_id"`
+	Content         string        `json:"content"`
+	Seq             int64         `json:"seq"`
+	ClientMsgID     string        `json:"client_msg_id,omitempty"`
+	CreatedAt       time.Time     `json:"created_at"`
+	EditedAt        *time.Time    `json:"edited_at,omitempty"`
+	IsDeleted       bool          `json:"is_deleted"`
+	AuthorFirstName string        `json:"author_first_name"`
+	AuthorLastName  string        `json:"author_last_name"`
+	AuthorUsername  string        `json:"author_username"`
+	Reactions       []Reaction    `json:"reactions"`
+	ReplyTo         *MessageQuote `json:"reply_to,omitempty"`
+	ReplyCount      int           `json:"reply_count"`
+	Mentions        []Mention     `json:"mentions"`
+	Attachments     []Attachment  `json:"attachments"`
+}
+
+// MessageQuote is the parent a reply points at, shortened for display.
+type MessageQuote struct {
+	ID              string `json:"id"`
+	UserID          string `json:"user_id"`
+	Snippet         string `json:"snippet"`
+	IsDeleted       bool   `json:"is_deleted"`
+	AuthorFirstName string `json:"author_first_name"`
+	AuthorLastName  string `json:"author_last_name"`
+}
+
+// Reaction summarises one emoji on a message from the viewer's point of view.
+type Reaction struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+type PinnedMessage struct {
+	Message
+	PinnedBy string    `json:"pinned_by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+type MessageEdit struct {
+	Content  string    `json:"content"`
+	EditedAt time.Time `json:"edited_at"`
 }
 
 type ChatRepo struct {
@@ -38,9 +97,11 @@ func NewChatRepo(db *pgxpool.Pool) *ChatRepo {
 	return &ChatRepo{db: db}
 }
 
-func (r *ChatRepo) GetUserConversations(ctx context.Context, userID string) ([]Conversation, error) {
+// GetUserConversations lists the user's conversations, pinned ones first.
+// Archived conversations are left out unless includeArchived is set.
+func (r *ChatRepo) GetUserConversations(ctx context.Context, userID string, includeArchived bool) ([]Conversation, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT DISTINCT
+		SELECT
 			c.id::text,
 			c.is_group,
 			COALESCE(c.name, ''),
@@ -65,12 +126,16 @@ func (r *ChatRepo) GetUserConversations(ctx context.Context, userID string) ([]C
 				 WHERE cp2.conversation_id = c.id AND u.id != $1::uuid
 				 LIMIT 1)
 			ELSE ''
-			END as other_last_name
+			END as other_last_name,
+			CASE WHEN cp.muted_until > NOW() THEN cp.muted_until END,
+			cp.archived,
+			cp.pinned_at IS NOT NULL
 		FROM conversations c
 		JOIN conversation_participants cp ON cp.conversation_id = c.id
 		WHERE cp.user_id = $1::uuid
-		ORDER BY c.created_at DESC
-	`, userID)
+		  AND ($2 OR NOT cp.archived)
+		ORDER BY cp.pinned_at DESC NULLS LAST, c.created_at DESC
+	`, userID, includeArchived)
 	if err != nil {
 		return nil, err
 	}
@@ -80,7 +145,8 @@ func (r *ChatRepo) GetUserConversations(ctx context.Context, userID string) ([]C
 	for rows.Next() {
 		var c Conversation
 		err := rows.Scan(&c.ID, &c.IsGroup, &c.Name, &c.CreatedAt,
-			&c.OtherUserID, &c.OtherUserFirstName, &c.OtherUserLastName)
+			&c.OtherUserID, &c.OtherUserFirstName, &c.OtherUserLastName,
+			&c.MutedUntil, &c.IsArchived, &c.IsPinned)
 		if err != nil {
 			return nil, err
 		}
@@ -126,22 +192,90 @@ func (r *ChatRepo) GetOrCreateConversation(ctx context.Context, userID, otherUse
 	return convID, err
 }
 
-func (r *ChatRepo) GetMessages(ctx context.Context, conversationID string, limit int) ([]Message, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT 
+// messageSelect is shared by every query that returns full messages, so they
+// scan the same way. Callers append WHERE/ORDER clauses.
+const messageSelect = `
+		SELECT
 			m.id::text,
 			m.conversation_id::text,
 			m.user_id::text,
 			m.content,
+			m.seq,
+			COALESCE(m.client_msg_id, ''),
 			m.created_at,
+			m.edited_at,
+			m.deleted_at IS NOT NULL,
 			u.first_name,
-			u.last_name
+			u.last_name,
+			COALESCE(u.username, ''),
+			p.id::text,
+			p.user_id::text,
+			p.content,
+			p.deleted_at IS NOT NULL,
+			pu.first_name,
+			pu.last_name,
+			(SELECT COUNT(*) FROM messages c
+			 WHERE c.reply_to_message_id = m.id AND c.deleted_at IS NULL),
+			COALESCE((
+				SELECT json_agg(json_build_object(
+					'user_id', mn.user_id, 'handle', mn.handle,
+					'offset', mn.offset_utf16, 'length', mn.length_utf16
+				) ORDER BY mn.offset_utf16)
+				FROM mentions mn WHERE mn.message_id = m.id
+			), '[]')
 		FROM messages m
 		JOIN users u ON m.user_id = u.id
-		WHERE m.conversation_id = $1::uuid
-		ORDER BY m.created_at DESC
+		LEFT JOIN messages p ON p.id = m.reply_to_message_id
+		LEFT JOIN users pu ON pu.id = p.user_id
+`
+
+func scanMessage(row pgx.Row) (Message, error) {
+	var m Message
+	var parentID, parentUserID, parentContent, parentFirst, parentLast *string
+	var parentDeleted *bool
+	err := row.Scan(&m.ID, &m.ConversationID, &m.UserID, &m.Content, &m.Seq, &m.ClientMsgID, &m.CreatedAt,
+		&m.EditedAt, &m.IsDeleted, &m.AuthorFirstName, &m.AuthorLastName, &m.AuthorUsername,
+		&parentID, &parentUserID, &parentContent, &parentDeleted, &parentFirst, &parentLast,
+		&m.ReplyCount, &m.Mentions)
+	if err != nil {
+		return m, err
+	}
+	if parentID != nil {
+		m.ReplyTo = &MessageQuote{
+			ID:              *parentID,
+			UserID:          *parentUserID,
+			Snippet:         QuoteSnippet(*parentContent),
+			IsDeleted:       *parentDeleted,
+			AuthorFirstName: *parentFirst,
+			AuthorLastName:  *parentLast,
+		}
+	}
+	return m, nil
+}
+
+// QuoteSnippet shortens a message for display inside a reply.
+func QuoteSnippet(content string) string {
+	const maxRunes = 140
+	runes := []rune(content)
+	if len(runes) <= maxRunes {
+		return content
+	}
+	return string(runes[:maxRunes]) + "…"
+}
+
+// GetMessages returns the newest messages of a conversation in chronological
+// order. With afterSeq > 0 it returns the oldest messages after that seq
+// instead, which lets clients fill gaps they detected.
+func (r *ChatRepo) GetMessages(ctx context.Context, conversationID, currentUserID string, afterSeq int64, limit int) ([]Message, error) {
+	order := "DESC"
+	if afterSeq > 0 {
+		order = "ASC"
+	}
+	rows, err := r.db.Query(ctx, messageSelect+`
+		WHERE m.conversation_id = $1::uuid AND m.seq > $3
+		ORDER BY m.seq `+order+`
 		LIMIT $2
-	`, conversationID, limit)
+	`, conversationID, limit, afterSeq)
 	if err != nil {
 		return nil, err
 	}
@@ -149,9 +283,7 @@ func (r *ChatRepo) GetMessages(ctx context.Context, conversationID string, limit
 
 	var messages []Message
 	for rows.Next() {
-		var m Message
-		err := rows.Scan(&m.ID, &m.ConversationID, &m.UserID, &m.Content, &m.CreatedAt,
-			&m.AuthorFirstName, &m.AuthorLastName)
+		m, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -159,26 +291,805 @@ func (r *ChatRepo) GetMessages(ctx context.Context, conversationID string, limit
 	}
 
 	// Reverse to get chronological order
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	if err := r.attachReactions(ctx, messages, currentUserID); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
 	}
 
 	return messages, nil
 }
 
-func (r *ChatRepo) SaveMessage(ctx context.Context, conversationID, userID, content string) (string, error) {
-	var id string
+// GetThread returns the replies to a message in chronological order.
+func (r *ChatRepo) GetThread(ctx context.Context, parentID, currentUserID string, limit int) ([]Message, error) {
+	rows, err := r.db.Query(ctx, messageSelect+`
+		WHERE m.reply_to_message_id = $1::uuid
+		ORDER BY m.created_at ASC
+		LIMIT $2
+	`, parentID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	if err := r.attachReactions(ctx, messages, currentUserID); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// GetConversationSeqs returns the seq of the newest message in each of the
+// user's conversations that has any.
+func (r *ChatRepo) GetConversationSeqs(ctx context.Context, userID string) (map[string]int64, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT c.id::text, c.last_seq
+		FROM conversations c
+		JOIN conversation_participants cp ON cp.conversation_id = c.id
+		WHERE cp.user_id = $1::uuid AND c.last_seq > 0
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seqs := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var seq int64
+		if err := rows.Scan(&id, &seq); err != nil {
+			return nil, err
+		}
+		seqs[id] = seq
+	}
+	return seqs, rows.Err()
+}
+
+// GetMessagesAfter returns the messages of the user's conversations whose
+// seq is above the one given for their conversation (every message of a
+// conversation that isn't listed), oldest first. Deleted messages are skipped.
+func (r *ChatRepo) GetMessagesAfter(ctx context.Context, userID string, after map[string]int64, limit int) ([]Message, error) {
+	convIDs := make([]string, 0, len(after))
+	seqs := make([]int64, 0, len(after))
+	for id, seq := range after {
+		convIDs = append(convIDs, id)
+		seqs = append(seqs, seq)
+	}
+
+	rows, err := r.db.Query(ctx, messageSelect+`
+		JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id
+		LEFT JOIN unnest($2::uuid[], $3::bigint[]) AS a(conversation_id, seq)
+			ON a.conversation_id = m.conversation_id
+		WHERE cp.user_id = $1::uuid AND m.seq > COALESCE(a.seq, 0) AND m.deleted_at IS NULL
+		ORDER BY m.created_at ASC, m.seq ASC
+		LIMIT $4
+	`, userID, convIDs, seqs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	if err := r.attachReactions(ctx, messages, userID); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+type NewMessage struct {
+	ConversationID string
+	UserID         string
+	Content        string
+	ReplyToID      string   // optional
+	ClientMsgID    string   // optional
+	AttachmentIDs  []string // optional, the sender's unused uploads
+}
+
+type SavedMessage struct {
+	ID        string
+	Seq       int64
+	CreatedAt time.Time
+	// Duplicate is set when the sender already stored a message with this
+	// ClientMsgID in the same conversation; the fields above then describe
+	// that earlier message.
+	Duplicate bool
+}
+
+// SaveMessage stores a message under the conversation's next sequence number.
+// A retried send with the same ClientMsgID returns the original instead.
+func (r *ChatRepo) SaveMessage(ctx context.Context, m NewMessage) (*SavedMessage, error) {
+	if m.ClientMsgID != "" {
+		if saved, err := r.findByClientMsgID(ctx, m.ConversationID, m.UserID, m.ClientMsgID); err == nil {
+			return saved, nil
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The row lock on the conversation orders concurrent senders, so seqs
+	// have no gaps; a rolled-back insert gives its number back.
+	saved := &SavedMessage{}
+	err = tx.QueryRow(ctx, `
+		UPDATE conversations SET last_seq = last_seq + 1
+		WHERE id = $1::uuid
+		RETURNING last_seq
+	`, m.ConversationID).Scan(&saved.Seq)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO messages (conversation_id, user_id, content, seq, client_msg_id, reply_to_message_id)
+		VALUES ($1::uuid, $2::uuid, $3, $4, NULLIF($5, ''), NULLIF($6, '')::uuid)
+		ON CONFLICT (conversation_id, user_id, client_msg_id) DO NOTHING
+		RETURNING id::text, created_at
+	`, m.ConversationID, m.UserID, m.Content, saved.Seq, m.ClientMsgID, m.ReplyToID).Scan(&saved.ID, &saved.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// A concurrent retry won the race.
+		tx.Rollback(ctx)
+		return r.findByClientMsgID(ctx, m.ConversationID, m.UserID, m.ClientMsgID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setMentions(ctx, tx, "message_id", saved.ID, m.Content, m.ConversationID); err != nil {
+		return nil, err
+	}
+	if err := linkAttachments(ctx, tx, "message_id", saved.ID, m.UserID, m.AttachmentIDs); err != nil {
+		return nil, err
+	}
+
+	return saved, tx.Commit(ctx)
+}
+
+func (r *ChatRepo) findByClientMsgID(ctx context.Context, conversationID, userID, clientMsgID string) (*SavedMessage, error) {
+	saved := &SavedMessage{Duplicate: true}
 	err := r.db.QueryRow(ctx, `
-		INSERT INTO messages (conversation_id, user_id, content)
+		SELECT id::text, seq, created_at
+		FROM messages
+		WHERE conversation_id = $1::uuid AND user_id = $2::uuid AND client_msg_id = $3
+	`, conversationID, userID, clientMsgID).Scan(&saved.ID, &saved.Seq, &saved.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+func (r *ChatRepo) GetMessage(ctx context.Context, id string) (*Message, error) {
+	m, err := scanMessage(r.db.QueryRow(ctx, messageSelect+`
+		WHERE m.id = $1::uuid
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetMessageFor is GetMessage with reactions, seen by currentUserID, and
+// attachments filled in, as GetMessages returns them.
+func (r *ChatRepo) GetMessageFor(ctx context.Context, id, currentUserID string) (*Message, error) {
+	m, err := r.GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []Message{*m}
+	if err := r.attachReactions(ctx, messages, currentUserID); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// EditMessage replaces the content and its mentions, and keeps the previous
+// version in message_edits.
+func (r *ChatRepo) EditMessage(ctx context.Context, id, content string) (time.Time, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO message_edits (message_id, content, edited_at)
+		SELECT id, content, COALESCE(edited_at, created_at)
+		FROM messages
+		WHERE id = $1::uuid
+	`, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var editedAt time.Time
+	var convID string
+	err = tx.QueryRow(ctx, `
+		UPDATE messages
+		SET content = $2, edited_at = NOW()
+		WHERE id = $1::uuid AND deleted_at IS NULL
+		RETURNING edited_at, conversation_id::text
+	`, id, content).Scan(&editedAt, &convID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := setMentions(ctx, tx, "message_id", id, content, convID); err != nil {
+		return time.Time{}, err
+	}
+
+	return editedAt, tx.Commit(ctx)
+}
+
+// DeleteMessage turns the message into a tombstone. The content and edit
+// history are wiped so an unsent message can't be recovered.
+func (r *ChatRepo) DeleteMessage(ctx context.Context, id string) (time.Time, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var deletedAt time.Time
+	err = tx.QueryRow(ctx, `
+		UPDATE messages
+		SET content = '', deleted_at = NOW()
+		WHERE id = $1::uuid AND deleted_at IS NULL
+		RETURNING deleted_at
+	`, id).Scan(&deletedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM message_edits WHERE message_id = $1::uuid`, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM message_reactions WHERE message_id = $1::uuid`, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM pinned_messages WHERE message_id = $1::uuid`, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM mentions WHERE message_id = $1::uuid`, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return deletedAt, tx.Commit(ctx)
+}
+
+// GetMessageEdits returns earlier versions of a message, oldest first.
+func (r *ChatRepo) GetMessageEdits(ctx context.Context, messageID string) ([]MessageEdit, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT content, edited_at
+		FROM message_edits
+		WHERE message_id = $1::uuid
+		ORDER BY edited_at ASC
+	`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var edits []MessageEdit
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.Content, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// AddReaction records userID's emoji on the message and returns how many
+// users reacted with it. A message holds at most maxEmojis different emojis.
+func (r *ChatRepo) AddReaction(ctx context.Context, messageID, userID, emoji string, maxEmojis int) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the message so concurrent reactions can't both pass the limit check.
+	_, err = tx.Exec(ctx, `SELECT 1 FROM messages WHERE id = $1::uuid FOR UPDATE`, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	var distinct int
+	var present bool
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(DISTINCT emoji), COALESCE(BOOL_OR(emoji = $2), false)
+		FROM message_reactions
+		WHERE message_id = $1::uuid
+	`, messageID, emoji).Scan(&distinct, &present)
+	if err != nil {
+		return 0, err
+	}
+	if !present && distinct >= maxEmojis {
+		return 0, ErrReactionLimit
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO message_reactions (message_id, user_id, emoji)
 		VALUES ($1::uuid, $2::uuid, $3)
-		RETURNING id
-	`, conversationID, userID, content).Scan(&id)
-	return id, err
+		ON CONFLICT (message_id, user_id, emoji) DO NOTHING
+	`, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := countReaction(ctx, tx, messageID, emoji)
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit(ctx)
+}
+
+// RemoveReaction deletes userID's emoji and returns how many users still react with it.
+func (r *ChatRepo) RemoveReaction(ctx context.Context, messageID, userID, emoji string) (int, error) {
+	_, err := r.db.Exec(ctx, `
+		DELETE FROM message_reactions
+		WHERE message_id = $1::uuid AND user_id = $2::uuid AND emoji = $3
+	`, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+	return countReaction(ctx, r.db, messageID, emoji)
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func countReaction(ctx context.Context, q queryRower, messageID, emoji string) (int, error) {
+	var count int
+	err := q.QueryRow(ctx, `
+		SELECT COUNT(*) FROM message_reactions
+		WHERE message_id = $1::uuid AND emoji = $2
+	`, messageID, emoji).Scan(&count)
+	return count, err
+}
+
+// attachReactions fills in Reactions for each message with one extra query.
+func (r *ChatRepo) attachReactions(ctx context.Context, messages []Message, currentUserID string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	byID := make(map[string]*Message, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+		byID[messages[i].ID] = &messages[i]
+		messages[i].Reactions = []Reaction{}
+	}
+
+	rows, err := r.db.Query(ctx, `
+		SELECT
+			message_id::text,
+			emoji,
+			COUNT(*),
+			BOOL_OR(user_id = $2::uuid)
+		FROM message_reactions
+		WHERE message_id = ANY($1::uuid[])
+		GROUP BY message_id, emoji
+		ORDER BY MIN(created_at)
+	`, ids, currentUserID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var re Reaction
+		if err := rows.Scan(&messageID, &re.Emoji, &re.Count, &re.ReactedByMe); err != nil {
+			return err
+		}
+		if m, ok := byID[messageID]; ok {
+			m.Reactions = append(m.Reactions, re)
+		}
+	}
+	return rows.Err()
+}
+
+func (r *ChatRepo) attachAttachments(ctx context.Context, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(messages))
+	for i := range messages {
+		ids[i] = messages[i].ID
+	}
+
+	byMessage, err := loadAttachments(ctx, r.db, "message_id", ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if messages[i].IsDeleted {
+			messages[i].Attachments = []Attachment{}
+			continue
+		}
+		messages[i].Attachments = byMessage[messages[i].ID]
+		if messages[i].Attachments == nil {
+			messages[i].Attachments = []Attachment{}
+		}
+	}
+	return nil
+}
+
+type MessageSearchResult struct {
+	ID              string    `json:"id"`
+	ConversationID  string    `json:"conversation_id"`
+	UserID          string    `json:"user_id"`
+	AuthorFirstName string    `json:"author_first_name"`
+	AuthorLastName  string    `json:"author_last_name"`
+	CreatedAt       time.Time `json:"created_at"`
+	// Snippet is raw message text around the matches, minus any marker
+	// characters of its own. Matched words are wrapped in
+	// HighlightStart/HighlightStop.
+	Snippet string  `json:"snippet"`
+	Rank    float32 `json:"rank"`
+}
+
+// Markers ts_headline puts around matches. They are stripped from the message
+// text first, so callers can escape the snippet and then swap these in safely.
+const (
+	HighlightStart = "\x01"
+	HighlightStop  = "\x02"
+)
+
+type MessageSearch struct {
+	UserID         string
+	Query          string
+	Language       string // text search config used for highlighting: russian or english
+	ConversationID string // optional
+	From, To       *time.Time
+	Limit, Offset  int
+}
+
+// SearchMessages finds messages matching the query in conversations the user
+// takes part in, best matches first. The query is parsed with both Russian
+// and English stemming so either language finds its word forms.
+func (r *ChatRepo) SearchMessages(ctx context.Context, s MessageSearch) ([]MessageSearchResult, error) {
+	rows, err := r.db.Query(ctx, `
+		WITH q AS (
+			SELECT websearch_to_tsquery('russian', $2) || websearch_to_tsquery('english', $2) AS query
+		)
+		SELECT
+			m.id::text,
+			m.conversation_id::text,
+			m.user_id::text,
+			u.first_name,
+			u.last_name,
+			m.created_at,
+			ts_headline($3::regconfig, translate(m.content, $8 || $9, ''), q.query,
+				'StartSel=' || $8 || ', StopSel=' || $9 || ', MaxFragments=2, MaxWords=20, MinWords=5'),
+			ts_rank(m.search_vector, q.query)
+		FROM q, messages m
+		JOIN conversation_participants cp
+			ON cp.conversation_id = m.conversation_id AND cp.user_id = $1::uuid
+		JOIN users u ON u.id = m.user_id
+		WHERE m.search_vector @@ q.query
+		  AND m.deleted_at IS NULL
+		  AND ($4 = '' OR m.conversation_id = NULLIF($4, '')::uuid)
+		  AND ($5::timestamp IS NULL OR m.created_at >= $5)
+		  AND ($6::timestamp IS NULL OR m.created_at < $6)
+		ORDER BY ts_rank(m.search_vector, q.query) DESC, m.created_at DESC
+		LIMIT $7 OFFSET $10
+	`, s.UserID, s.Query, s.Language, s.ConversationID, s.From, s.To, s.Limit,
+		HighlightStart, HighlightStop, s.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []MessageSearchResult
+	for rows.Next() {
+		var res MessageSearchResult
+		err := rows.Scan(&res.ID, &res.ConversationID, &res.UserID, &res.AuthorFirstName,
+			&res.AuthorLastName, &res.CreatedAt, &res.Snippet, &res.Rank)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// UpdateSettings changes the user's personal settings for a conversation.
+// It returns pgx.ErrNoRows if the user is not a participant.
+func (r *ChatRepo) UpdateSettings(ctx context.Context, conversationID, userID string, s ConversationSettings) error {
+	var unmute bool
+	if s.MutedUntil != nil && s.MutedUntil.IsZero() {
+		unmute, s.MutedUntil = true, nil
+	}
+
+	var id string
+	return r.db.QueryRow(ctx, `
+		UPDATE conversation_participants
+		SET muted_until = CASE WHEN $3 THEN NULL ELSE COALESCE($4, muted_until) END,
+		    archived = COALESCE($5, archived),
+		    pinned_at = CASE
+		        WHEN $6::boolean IS NULL THEN pinned_at
+		        WHEN $6 THEN COALESCE(pinned_at, NOW())
+		        ELSE NULL
+		    END
+		WHERE conversation_id = $1::uuid AND user_id = $2::uuid
+		RETURNING id::text
+	`, conversationID, userID, unmute, s.MutedUntil, s.Archived, s.Pinned).Scan(&id)
+}
+
+// GetNotifiableUserIDs returns the participants who should be notified about
+// activity in the conversation: everyone except exceptUserID and anyone who muted it.
+func (r *ChatRepo) GetNotifiableUserIDs(ctx context.Context, conversationID, exceptUserID string) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT user_id::text
+		FROM conversation_participants
+		WHERE conversation_id = $1::uuid
+		  AND user_id != $2::uuid
+		  AND (muted_until IS NULL OR muted_until <= NOW())
+	`, conversationID, exceptUserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetParticipant returns whether the conversation is a group and the user's
+// role in it, or pgx.ErrNoRows if the user is not a participant.
+func (r *ChatRepo) GetParticipant(ctx context.Context, conversationID, userID string) (isGroup bool, role string, err error) {
+	err = r.db.QueryRow(ctx, `
+		SELECT c.is_group, cp.role
+		FROM conversation_participants cp
+		JOIN conversations c ON c.id = cp.conversation_id
+		WHERE cp.conversation_id = $1::uuid AND cp.user_id = $2::uuid
+	`, conversationID, userID).Scan(&isGroup, &role)
+	return isGroup, role, err
+}
+
+// PinMessage pins a message in its conversation, which holds at most maxPins.
+// Pinning an already pinned message is a no-op that returns the original pin time.
+func (r *ChatRepo) PinMessage(ctx context.Context, conversationID, messageID, userID string, maxPins int) (time.Time, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Serialise pins per conversation so the cap can't be overshot.
+	_, err = tx.Exec(ctx, `SELECT 1 FROM conversations WHERE id = $1::uuid FOR UPDATE`, conversationID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var pinnedAt time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT pinned_at FROM pinned_messages
+		WHERE conversation_id = $1::uuid AND message_id = $2::uuid
+	`, conversationID, messageID).Scan(&pinnedAt)
+	if err == nil {
+		return pinnedAt, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, err
+	}
+
+	var count int
+	err = tx.QueryRow(ctx, `
+		SELECT COUNT(*) FROM pinned_messages WHERE conversation_id = $1::uuid
+	`, conversationID).Scan(&count)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if count >= maxPins {
+		return time.Time{}, ErrPinLimit
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO pinned_messages (conversation_id, message_id, pinned_by)
+		VALUES ($1::uuid, $2::uuid, $3::uuid)
+		RETURNING pinned_at
+	`, conversationID, messageID, userID).Scan(&pinnedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return pinnedAt, tx.Commit(ctx)
+}
+
+// UnpinMessage reports whether the message was pinned.
+func (r *ChatRepo) UnpinMessage(ctx context.Context, conversationID, messageID string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM pinned_messages
+		WHERE conversation_id = $1::uuid AND message_id = $2::uuid
+	`, conversationID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// GetPinnedMessages lists the conversation's pins, most recently pinned first.
+func (r *ChatRepo) GetPinnedMessages(ctx context.Context, conversationID, currentUserID string) ([]PinnedMessage, error) {
+	rows, err := r.db.Query(ctx, messageSelect+`
+		JOIN pinned_messages pm ON pm.message_id = m.id AND pm.conversation_id = m.conversation_id
+		WHERE m.conversation_id = $1::uuid
+		ORDER BY pm.pinned_at DESC
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := r.attachReactions(ctx, messages, currentUserID); err != nil {
+		return nil, err
+	}
+	if err := r.attachAttachments(ctx, messages); err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string]*PinnedMessage, len(messages))
+	result := make([]PinnedMessage, len(messages))
+	for i, m := range messages {
+		result[i].Message = m
+		pins[m.ID] = &result[i]
+	}
+
+	pinRows, err := r.db.Query(ctx, `
+		SELECT message_id::text, COALESCE(pinned_by::text, ''), pinned_at
+		FROM pinned_messages
+		WHERE conversation_id = $1::uuid
+	`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer pinRows.Close()
+
+	for pinRows.Next() {
+		var messageID, pinnedBy string
+		var pinnedAt time.Time
+		if err := pinRows.Scan(&messageID, &pinnedBy, &pinnedAt); err != nil {
+			return nil, err
+		}
+		if p, ok := pins[messageID]; ok {
+			p.PinnedBy, p.PinnedAt = pinnedBy, pinnedAt
+		}
+	}
+	return result, pinRows.Err()
+}
+
+func (r *ChatRepo) IsParticipant(ctx context.Context, conversationID, userID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow(ctx, `
+		SELECT EXISTS(
+			SELECT 1 FROM conversation_participants
+			WHERE conversation_id = $1::uuid AND user_id = $2::uuid
+		)
+	`, conversationID, userID).Scan(&exists)
+	return exists, err
+}
+
+func (r *ChatRepo) GetUserConversationIDs(ctx context.Context, userID string) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT conversation_id::text
+		FROM conversation_participants
+		WHERE user_id = $1::uuid
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetPeerUserIDs returns the distinct users who share at least one conversation with userID.
+func (r *ChatRepo) GetPeerUserIDs(ctx context.Context, userID string) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT other.user_id::text
+		FROM conversation_participants me
+		JOIN conversation_participants other ON other.conversation_id = me.conversation_id
+		WHERE me.user_id = $1::uuid AND other.user_id != $1::uuid
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 func (r *ChatRepo) GetAllUsers(ctx context.Context, currentUserID string) ([]User, error) {
 	rows, err := r.db.Query(ctx, `
-		SELECT id::text, email, first_name, last_name, role
+		SELECT id::text, COALESCE(username, ''), first_name, last_name, role
 		FROM users
 		WHERE id != $1::uuid
 		ORDER BY first_name, last_name
@@ -191,7 +1102,7 @@ func (r *ChatRepo) GetAllUsers(ctx context.Context, currentUserID string) ([]Use
 	var users []User
 	for rows.Next() {
 		var u User
-		err := rows.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.Role)
+		err := rows.Scan(&u.ID, &u.Username, &u.FirstName, &u.LastName, &u.Role)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,131 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// FollowUser is an entry in a follower or following list.
+type FollowUser struct {
+	ID             string    `json:"id"`
+	Username       string    `json:"username"`
+	FirstName      string    `json:"first_name"`
+	LastName       string    `json:"last_name"`
+	Role           string    `json:"role"`
+	FollowedAt     time.Time `json:"followed_at"`
+	IsFollowedByMe bool      `json:"is_followed_by_me"`
+}
+
+type FollowCounts struct {
+	Followers int `json:"followers_count"`
+	Following int `json:"following_count"`
+}
+
+type FollowRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewFollowRepo(db *pgxpool.Pool) *FollowRepo {
+	return &FollowRepo{db: db}
+}
+
+// Follow makes followerID follow followeeID. It reports false if they already did.
+func (r *FollowRepo) Follow(ctx context.Context, followerID, followeeID string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		INSERT INTO follows (follower_id, followee_id)
+		VALUES ($1::uuid, $2::uuid)
+		ON CONFLICT DO NOTHING
+	`, followerID, followeeID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Unfollow reports false if followerID wasn't following followeeID.
+func (r *FollowRepo) Unfollow(ctx context.Context, followerID, followeeID string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		DELETE FROM follows
+		WHERE follower_id = $1::uuid AND followee_id = $2::uuid
+	`, followerID, followeeID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (r *FollowRepo) IsFollowing(ctx context.Context, followerID, followeeID string) (bool, error) {
+	var ok bool
+	err := r.db.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM follows WHERE follower_id = $1::uuid AND followee_id = $2::uuid)
+	`, followerID, followeeID).Scan(&ok)
+	return ok, err
+}
+
+func (r *FollowRepo) GetCounts(ctx context.Context, userID string) (FollowCounts, error) {
+	var c FollowCounts
+	err := r.db.QueryRow(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM follows WHERE followee_id = $1::uuid),
+			(SELECT COUNT(*) FROM follows WHERE follower_id = $1::uuid)
+	`, userID).Scan(&c.Followers, &c.Following)
+	return c, err
+}
+
+// GetFollowers lists who follows userID, most recent first.
+func (r *FollowRepo) GetFollowers(ctx context.Context, userID, currentUserID string, limit, offset int) ([]FollowUser, error) {
+	return r.queryFollowUsers(ctx, `
+		SELECT
+			u.id::text,
+			COALESCE(u.username, ''),
+			u.first_name,
+			u.last_name,
+			u.role,
+			f.created_at,
+			EXISTS(SELECT 1 FROM follows m WHERE m.follower_id = $2::uuid AND m.followee_id = u.id)
+		FROM follows f
+		JOIN users u ON u.id = f.follower_id
+		WHERE f.followee_id = $1::uuid
+		ORDER BY f.created_at DESC
+		LIMIT $3 OFFSET $4
+	`, userID, currentUserID, limit, offset)
+}
+
+// GetFollowing lists who userID follows, most recent first.
+func (r *FollowRepo) GetFollowing(ctx context.Context, userID, currentUserID string, limit, offset int) ([]FollowUser, error) {
+	return r.queryFollowUsers(ctx, `
+		SELECT
+			u.id::text,
+			COALESCE(u.username, ''),
+			u.first_name,
+			u.last_name,
+			u.role,
+			f.created_at,
+			EXISTS(SELECT 1 FROM follows m WHERE m.follower_id = $2::uuid AND m.followee_id = u.id)
+		FROM follows f
+		JOIN users u ON u.id = f.followee_id
+		WHERE f.follower_id = $1::uuid
+		ORDER BY f.created_at DESC
+		LIMIT $3 OFFSET $4
+	`, userID, currentUserID, limit, offset)
+}
+
+func (r *FollowRepo) queryFollowUsers(ctx context.Context, sql string, args ...any) ([]FollowUser, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []FollowUser
+	for rows.Next() {
+		var u FollowUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.FirstName, &u.LastName, &u.Role, &u.FollowedAt, &u.IsFollowedByMe); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
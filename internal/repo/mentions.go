@@ -0,0 +1,55 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+
+	"aitu-connect/internal/mention"
+)
+
+// Mention is an @handle in a post, comment or message that resolved to a
+// user. Offset and Length are in UTF-16 code units of the content and
+// include the '@'.
+type Mention struct {
+	UserID string `json:"user_id"`
+	Handle string `json:"handle"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// setMentions replaces the mentions of an owner (column is post_id,
+// comment_id or message_id) with the @handles in content that name a user.
+// A handle is a username, or one its owner gave up within the redirect period.
+// When conversationID is set only its participants can be mentioned.
+func setMentions(ctx context.Context, tx pgx.Tx, column, ownerID, content, conversationID string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM mentions WHERE `+column+` = $1::uuid`, ownerID); err != nil {
+		return err
+	}
+
+	refs := mention.Parse(content)
+	if len(refs) == 0 {
+		return nil
+	}
+	handles := make([]string, len(refs))
+	offsets := make([]int, len(refs))
+	lengths := make([]int, len(refs))
+	for i, ref := range refs {
+		handles[i], offsets[i], lengths[i] = ref.Handle, ref.Offset, ref.Length
+	}
+
+	_, err := tx.Exec(ctx, `
+		INSERT INTO mentions (`+column+`, user_id, handle, offset_utf16, length_utf16)
+		SELECT $1::uuid, u.id, m.handle, m.off, m.len
+		FROM unnest($2::text[], $3::int[], $4::int[]) AS m(handle, off, len)
+		JOIN users u ON u.id = COALESCE(
+			(SELECT id FROM users WHERE LOWER(username) = m.handle),
+			(SELECT user_id FROM username_redirects WHERE username = m.handle AND expires_at > NOW())
+		)
+		WHERE $5 = '' OR EXISTS (
+			SELECT 1 FROM conversation_participants cp
+			WHERE cp.conversation_id = NULLIF($5, '')::uuid AND cp.user_id = u.id
+		)
+	`, ownerID, handles, offsets, lengths, conversationID)
+	return err
+}
@@ -2,34 +2,77 @@ package repo
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"aitu-connect/internal/hashtag"
 )
 
 type Post struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	IsEdited  bool       `json:"is_edited"`
+	IsDeleted bool       `json:"is_deleted"`
 	// Joined fields
-	AuthorFirstName string `json:"author_first_name"`
-	AuthorLastName  string `json:"author_last_name"`
-	AuthorEmail     string `json:"author_email"`
-	LikesCount      int    `json:"likes_count"`
-	CommentsCount   int    `json:"comments_count"`
-	IsLikedByMe     bool   `json:"is_liked_by_me"`
+	AuthorFirstName string       `json:"author_first_name"`
+	AuthorLastName  string       `json:"author_last_name"`
+	AuthorUsername  string       `json:"author_username"`
+	LikesCount      int          `json:"likes_count"`
+	CommentsCount   int          `json:"comments_count"`
+	IsLikedByMe     bool         `json:"is_liked_by_me"`
+	Mentions        []Mention    `json:"mentions"`
+	Attachments     []Attachment `json:"attachments"`
+	// Ranking score, only set in the popular feed
+	Score float64 `json:"score,omitempty"`
 }
 
+// Comment is one node of a comment thread. Replies are not embedded; a
+// client shows ReplyCount and loads them on demand with GetReplies.
 type Comment struct {
-	ID              string    `json:"id"`
-	PostID          string    `json:"post_id"`
-	UserID          string    `json:"user_id"`
-	Content         string    `json:"content"`
-	CreatedAt       time.Time `json:"created_at"`
-	AuthorFirstName string    `json:"author_first_name"`
-	AuthorLastName  string    `json:"author_last_name"`
+	ID              string     `json:"id"`
+	PostID          string     `json:"post_id"`
+	UserID          string     `json:"user_id"`
+	ParentCommentID string     `json:"parent_comment_id,omitempty"`
+	Depth           int        `json:"depth"`
+	Content         string     `json:"content"`
+	CreatedAt       time.Time  `json:"created_at"`
+	EditedAt        *time.Time `json:"edited_at,omitempty"`
+	IsEdited        bool       `json:"is_edited"`
+	IsDeleted       bool       `json:"is_deleted"`
+	AuthorFirstName string     `json:"author_first_name"`
+	AuthorLastName  string     `json:"author_last_name"`
+	AuthorUsername  string     `json:"author_username"`
+	LikesCount      int        `json:"likes_count"`
+	IsLikedByMe     bool       `json:"is_liked_by_me"`
+	ReplyCount      int        `json:"reply_count"`
+	Mentions        []Mention  `json:"mentions"`
+}
+
+type NewComment struct {
+	PostID   string
+	UserID   string
+	ParentID string // optional
+	Depth    int    // parent's depth + 1 for replies
+	Content  string
+}
+
+// PostRevision is an earlier version of an edited post.
+type PostRevision struct {
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedBy string    `json:"replaced_by"`
+	ReplacedAt time.Time `json:"replaced_at"`
 }
 
 type PostRepo struct {
@@ -40,45 +83,227 @@ func NewPostRepo(db *pgxpool.Pool) *PostRepo {
 	return &PostRepo{db: db}
 }
 
-func (r *PostRepo) Create(ctx context.Context, userID, content string) (string, error) {
+// Create stores the post along with the hashtags and mentions in its content
+// and links the author's attachments, all or nothing.
+func (r *PostRepo) Create(ctx context.Context, userID, content string, attachmentIDs []string) (string, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
 	var id string
-	err := r.db.QueryRow(ctx, `
+	err = tx.QueryRow(ctx, `
 		INSERT INTO posts (user_id, content)
 		VALUES ($1, $2)
 		RETURNING id
 	`, userID, content).Scan(&id)
-	return id, err
+	if err != nil {
+		return "", err
+	}
+
+	if err := setTags(ctx, tx, id, content); err != nil {
+		return "", err
+	}
+	if err := setMentions(ctx, tx, "post_id", id, content, ""); err != nil {
+		return "", err
+	}
+	if err := linkAttachments(ctx, tx, "post_id", id, userID, attachmentIDs); err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit(ctx)
 }
 
-func (r *PostRepo) GetFeed(ctx context.Context, currentUserID string, limit, offset int) ([]Post, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT 
+// setTags replaces the post's tags with the hashtags in content. Tags keep
+// the post's created_at, so editing an old post doesn't make it trend.
+func setTags(ctx context.Context, tx pgx.Tx, postID, content string) error {
+	if _, err := tx.Exec(ctx, `DELETE FROM post_tags WHERE post_id = $1::uuid`, postID); err != nil {
+		return err
+	}
+
+	tags := hashtag.Parse(content)
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO post_tags (post_id, tag, created_at)
+		SELECT p.id, t.tag, p.created_at
+		FROM posts p, unnest($2::text[]) AS t(tag)
+		WHERE p.id = $1::uuid
+	`, postID, tags)
+	return err
+}
+
+// postColumns selects everything scanPost expects from "posts p" joined
+// with "users u". $1 is the viewer, for is_liked_by_me.
+const postColumns = `
 			p.id::text,
 			p.user_id::text,
 			p.content,
 			p.created_at,
 			p.updated_at,
+			p.edited_at,
+			p.deleted_at IS NOT NULL,
 			u.first_name,
 			u.last_name,
-			u.email,
-			COALESCE(l.likes_count, 0) as likes_count,
-			COALESCE(c.comments_count, 0) as comments_count,
-			EXISTS(SELECT 1 FROM likes WHERE post_id = p.id AND user_id = $1::uuid) as is_liked
+			COALESCE(u.username, ''),
+			p.likes_count,
+			p.comments_count,
+			EXISTS(SELECT 1 FROM likes WHERE post_id = p.id AND user_id = $1::uuid) as is_liked,
+			COALESCE((
+				SELECT json_agg(json_build_object(
+					'user_id', mn.user_id, 'handle', mn.handle,
+					'offset', mn.offset_utf16, 'length', mn.length_utf16
+				) ORDER BY mn.offset_utf16)
+				FROM mentions mn WHERE mn.post_id = p.id
+			), '[]')`
+
+// postSelect is shared by the queries that return full posts; callers
+// append WHERE/ORDER clauses.
+const postSelect = `
+		SELECT` + postColumns + `
 		FROM posts p
 		JOIN users u ON p.user_id = u.id
-		LEFT JOIN (
-			SELECT post_id, COUNT(*) as likes_count
-			FROM likes
-			GROUP BY post_id
-		) l ON l.post_id = p.id
-		LEFT JOIN (
-			SELECT post_id, COUNT(*) as comments_count
-			FROM comments
-			GROUP BY post_id
-		) c ON c.post_id = p.id
-		ORDER BY p.created_at DESC
-		LIMIT $2 OFFSET $3
-	`, currentUserID, limit, offset)
+`
+
+// scanPost reads postColumns, after any extra columns selected in front of them.
+func scanPost(row pgx.Row, extra ...any) (Post, error) {
+	var p Post
+	dest := append(extra, &p.ID, &p.UserID, &p.Content, &p.CreatedAt, &p.UpdatedAt, &p.EditedAt, &p.IsDeleted,
+		&p.AuthorFirstName, &p.AuthorLastName, &p.AuthorUsername,
+		&p.LikesCount, &p.CommentsCount, &p.IsLikedByMe, &p.Mentions)
+	err := row.Scan(dest...)
+	p.IsEdited = p.EditedAt != nil
+	return p, err
+}
+
+// FeedCursor marks the last post of a feed page. Posts are ordered by
+// (created_at, id) descending, so a cursor stays valid while new posts arrive.
+type FeedCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+var ErrBadCursor = errors.New("invalid cursor")
+
+// String encodes the cursor for clients, who should treat it as opaque.
+func (c FeedCursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixMicro(), 10) + "_" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseFeedCursor(s string) (*FeedCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	micros, id, ok := strings.Cut(string(raw), "_")
+	if !ok || !IsUUID(id) {
+		return nil, ErrBadCursor
+	}
+	us, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	// created_at is a TIMESTAMP without time zone, read back as UTC.
+	return &FeedCursor{CreatedAt: time.UnixMicro(us).UTC(), ID: id}, nil
+}
+
+// GetFeed returns every visible post, newest first, starting after the
+// cursor if one is given.
+func (r *PostRepo) GetFeed(ctx context.Context, currentUserID string, after *FeedCursor, limit int) ([]Post, error) {
+	return r.queryFeed(ctx, currentUserID, after, limit, "")
+}
+
+// GetFollowingFeed returns posts by userID and by the users they follow,
+// newest first, starting after the cursor if one is given. Each author's
+// newest posts come off idx_posts_user_id and are merged, so the cost grows
+// with the number of followees rather than with the whole posts table. The
+// follows primary key starts with follower_id, which covers the followee lookup.
+func (r *PostRepo) GetFollowingFeed(ctx context.Context, userID string, after *FeedCursor, limit int) ([]Post, error) {
+	args := []any{userID, limit}
+	cursor := ""
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		cursor = `
+				  AND (created_at, id) < ($3, $4::uuid)`
+	}
+
+	return r.feedPosts(ctx, `
+		SELECT`+postColumns+`
+		FROM (
+			SELECT recent.id
+			FROM (
+				SELECT $1::uuid
+				UNION ALL
+				SELECT followee_id FROM follows WHERE follower_id = $1::uuid
+			) AS author(id)
+			CROSS JOIN LATERAL (
+				SELECT id, created_at FROM posts
+				WHERE user_id = author.id AND deleted_at IS NULL`+cursor+`
+				ORDER BY created_at DESC, id DESC
+				LIMIT $2
+			) AS recent
+			ORDER BY recent.created_at DESC, recent.id DESC
+			LIMIT $2
+		) AS page
+		JOIN posts p ON p.id = page.id
+		JOIN users u ON p.user_id = u.id
+		ORDER BY p.created_at DESC, p.id DESC
+	`, args...)
+}
+
+// GetTagFeed returns visible posts tagged with tag (in hashtag normal form),
+// newest first, starting after the cursor if one is given. The page is read
+// off idx_post_tags_tag; tags carry their post's created_at, so the cursor
+// applies to them directly.
+func (r *PostRepo) GetTagFeed(ctx context.Context, currentUserID, tag string, after *FeedCursor, limit int) ([]Post, error) {
+	args := []any{currentUserID, limit, tag}
+	cursor := ""
+	if after != nil {
+		args = append(args, after.CreatedAt, after.ID)
+		cursor = `
+			  AND (t.created_at, t.post_id) < ($4, $5::uuid)`
+	}
+
+	return r.feedPosts(ctx, `
+		SELECT`+postColumns+`
+		FROM (
+			SELECT t.post_id
+			FROM post_tags t
+			JOIN posts tp ON tp.id = t.post_id AND tp.deleted_at IS NULL
+			WHERE t.tag = $3`+cursor+`
+			ORDER BY t.created_at DESC, t.post_id DESC
+			LIMIT $2
+		) AS page
+		JOIN posts p ON p.id = page.post_id
+		JOIN users u ON p.user_id = u.id
+		ORDER BY p.created_at DESC, p.id DESC
+	`, args...)
+}
+
+// queryFeed runs a keyset-paginated feed query. filter is extra AND
+// conditions that may refer to the viewer as $1 and to filterArgs from $3 on.
+func (r *PostRepo) queryFeed(ctx context.Context, currentUserID string, after *FeedCursor, limit int, filter string, filterArgs ...any) ([]Post, error) {
+	args := append([]any{currentUserID, limit}, filterArgs...)
+	if after != nil {
+		n := len(args)
+		args = append(args, after.CreatedAt, after.ID)
+		filter += fmt.Sprintf(`
+		  AND (p.created_at, p.id) < ($%d, $%d::uuid)`, n+1, n+2)
+	}
+
+	return r.feedPosts(ctx, postSelect+`
+		WHERE p.deleted_at IS NULL`+filter+`
+		ORDER BY p.created_at DESC, p.id DESC
+		LIMIT $2
+	`, args...)
+}
+
+// feedPosts runs a query selecting postColumns and fills in attachments.
+func (r *PostRepo) feedPosts(ctx context.Context, sql string, args ...any) ([]Post, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -86,66 +311,470 @@ func (r *PostRepo) GetFeed(ctx context.Context, currentUserID string, limit, off
 
 	var posts []Post
 	for rows.Next() {
-		var p Post
-		err := rows.Scan(
-			&p.ID, &p.UserID, &p.Content, &p.CreatedAt, &p.UpdatedAt,
-			&p.AuthorFirstName, &p.AuthorLastName, &p.AuthorEmail,
-			&p.LikesCount, &p.CommentsCount, &p.IsLikedByMe,
-		)
+		p, err := scanPost(rows)
 		if err != nil {
 			return nil, err
 		}
 		posts = append(posts, p)
 	}
+
+	if err := r.attachAttachments(ctx, posts); err != nil {
+		return nil, err
+	}
 	return posts, nil
 }
 
-func (r *PostRepo) ToggleLike(ctx context.Context, userID, postID string) (bool, error) {
-	// Check if already liked
-	var exists bool
-	err := r.db.QueryRow(ctx, `
-		SELECT EXISTS(SELECT 1 FROM likes WHERE user_id = $1::uuid AND post_id = $2::uuid)
-	`, userID, postID).Scan(&exists)
+// PopularCursor marks the last post of a popular feed page, ordered by
+// (score, id) descending.
+type PopularCursor struct {
+	Score float64
+	ID    string
+}
+
+func (c PopularCursor) String() string {
+	raw := strconv.FormatFloat(c.Score, 'g', -1, 64) + "_" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParsePopularCursor(s string) (*PopularCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		return false, err
+		return nil, ErrBadCursor
 	}
+	score, id, ok := strings.Cut(string(raw), "_")
+	if !ok || !IsUUID(id) {
+		return nil, ErrBadCursor
+	}
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	return &PopularCursor{Score: f, ID: id}, nil
+}
 
-	if exists {
-		// Unlike
-		_, err = r.db.Exec(ctx, `DELETE FROM likes WHERE user_id = $1::uuid AND post_id = $2::uuid`, userID, postID)
-		return false, err
+// ScoreWeights tunes the popular feed ranking.
+type ScoreWeights struct {
+	Like     float64
+	Comment  float64
+	HalfLife time.Duration
+}
+
+// RefreshScores recomputes post_scores and returns how many changed.
+//
+// The score of a post is engagement decayed by age,
+//
+//	(1 + like*likes + comment*comments) * 2^(-age/halfLife)
+//
+// stored as its logarithm relative to the epoch rather than to now:
+//
+//	ln(1 + like*likes + comment*comments) + ln 2 * created_at/halfLife
+//
+// Both order posts the same way at any moment, since they differ only by a
+// term that depends on the current time and is the same for every post.
+// The stored form doesn't change as time passes, so a refresh only writes
+// posts whose counts moved, and feed cursors stay valid between refreshes.
+func (r *PostRepo) RefreshScores(ctx context.Context, w ScoreWeights) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		INSERT INTO post_scores (post_id, score)
+		SELECT
+			id,
+			ln(1 + $1::float8 * likes_count + $2::float8 * comments_count)
+				+ ln(2) * EXTRACT(EPOCH FROM created_at) / $3::float8
+		FROM posts
+		WHERE deleted_at IS NULL
+		ON CONFLICT (post_id) DO UPDATE
+		SET score = EXCLUDED.score, updated_at = NOW()
+		WHERE post_scores.score IS DISTINCT FROM EXCLUDED.score
+	`, w.Like, w.Comment, w.HalfLife.Seconds())
+	if err != nil {
+		return 0, err
 	}
+	return tag.RowsAffected(), nil
+}
 
-	// Like
-	_, err = r.db.Exec(ctx, `INSERT INTO likes (user_id, post_id) VALUES ($1::uuid, $2::uuid)`, userID, postID)
-	return true, err
+// GetPopularFeed returns visible posts by descending score, starting after
+// the cursor if one is given. Posts newer than the last refresh are missing
+// until the next one.
+func (r *PostRepo) GetPopularFeed(ctx context.Context, currentUserID string, after *PopularCursor, limit int) ([]Post, error) {
+	args := []any{currentUserID, limit}
+	cond := ""
+	if after != nil {
+		args = append(args, after.Score, after.ID)
+		cond = `
+		  AND (s.score, s.post_id) < ($3, $4::uuid)`
+	}
+
+	rows, err := r.db.Query(ctx, `
+		SELECT s.score,`+postColumns+`
+		FROM post_scores s
+		JOIN posts p ON p.id = s.post_id
+		JOIN users u ON p.user_id = u.id
+		WHERE p.deleted_at IS NULL`+cond+`
+		ORDER BY s.score DESC, s.post_id DESC
+		LIMIT $2
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var score float64
+		p, err := scanPost(rows, &score)
+		if err != nil {
+			return nil, err
+		}
+		p.Score = score
+		posts = append(posts, p)
+	}
+
+	if err := r.attachAttachments(ctx, posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
 }
 
-func (r *PostRepo) AddComment(ctx context.Context, userID, postID, content string) (string, error) {
-	var id string
+// GetPost returns a single post, including a soft-deleted one; callers
+// decide who may see it.
+func (r *PostRepo) GetPost(ctx context.Context, id, currentUserID string) (*Post, error) {
+	p, err := scanPost(r.db.QueryRow(ctx, postSelect+`
+		WHERE p.id = $2::uuid
+	`, currentUserID, id))
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []Post{p}
+	if err := r.attachAttachments(ctx, posts); err != nil {
+		return nil, err
+	}
+	return &posts[0], nil
+}
+
+// UpdatePost replaces the content and keeps the previous version in post_revisions.
+func (r *PostRepo) UpdatePost(ctx context.Context, id, editorID, content string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO post_revisions (post_id, content, created_at, replaced_by)
+		SELECT id, content, COALESCE(edited_at, created_at), $2::uuid
+		FROM posts
+		WHERE id = $1::uuid AND deleted_at IS NULL
+	`, id, editorID)
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE posts
+		SET content = $2, edited_at = NOW(), updated_at = NOW()
+		WHERE id = $1::uuid AND deleted_at IS NULL
+	`, id, content)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	if err := setTags(ctx, tx, id, content); err != nil {
+		return err
+	}
+	if err := setMentions(ctx, tx, "post_id", id, content, ""); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// TrendingTag is a tag with how much it was used over a time window.
+type TrendingTag struct {
+	Tag          string `json:"tag"`
+	PostsCount   int    `json:"posts_count"`
+	AuthorsCount int    `json:"authors_count"`
+}
+
+// GetTrendingTags returns the tags of visible posts created within window
+// of now. Tags are ranked by how many people used them, then by posts, so
+// a single account repeating a tag can't push it to the top.
+func (r *PostRepo) GetTrendingTags(ctx context.Context, window time.Duration, limit int) ([]TrendingTag, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT t.tag, COUNT(*), COUNT(DISTINCT p.user_id)
+		FROM post_tags t
+		JOIN posts p ON p.id = t.post_id
+		WHERE t.created_at > NOW() - make_interval(secs => $1::float8)
+		  AND p.deleted_at IS NULL
+		GROUP BY t.tag
+		ORDER BY COUNT(DISTINCT p.user_id) DESC, COUNT(*) DESC, t.tag
+		LIMIT $2
+	`, window.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []TrendingTag
+	for rows.Next() {
+		var t TrendingTag
+		if err := rows.Scan(&t.Tag, &t.PostsCount, &t.AuthorsCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// DeletePost hides the post. Content, revisions, comments and likes are kept
+// so a moderator can restore it.
+func (r *PostRepo) DeletePost(ctx context.Context, id, deletedBy string) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE posts
+		SET deleted_at = NOW(), deleted_by = $2::uuid
+		WHERE id = $1::uuid AND deleted_at IS NULL
+	`, id, deletedBy)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RestorePost undoes DeletePost.
+func (r *PostRepo) RestorePost(ctx context.Context, id string) error {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE posts
+		SET deleted_at = NULL, deleted_by = NULL
+		WHERE id = $1::uuid AND deleted_at IS NOT NULL
+	`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// GetRevisions returns earlier versions of a post, oldest first.
+func (r *PostRepo) GetRevisions(ctx context.Context, postID string) ([]PostRevision, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT content, created_at, COALESCE(replaced_by::text, ''), replaced_at
+		FROM post_revisions
+		WHERE post_id = $1::uuid
+		ORDER BY replaced_at ASC
+	`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var rev PostRevision
+		if err := rows.Scan(&rev.Content, &rev.CreatedAt, &rev.ReplacedBy, &rev.ReplacedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+func (r *PostRepo) attachAttachments(ctx context.Context, posts []Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(posts))
+	for i := range posts {
+		ids[i] = posts[i].ID
+	}
+
+	byPost, err := loadAttachments(ctx, r.db, "post_id", ids)
+	if err != nil {
+		return err
+	}
+	for i := range posts {
+		posts[i].Attachments = byPost[posts[i].ID]
+		if posts[i].Attachments == nil {
+			posts[i].Attachments = []Attachment{}
+		}
+	}
+	return nil
+}
+
+// ToggleLike likes the post if userID hasn't yet and unlikes it otherwise,
+// adjusting likes_count in the same statement. It returns the new state and
+// count, or pgx.ErrNoRows if the post doesn't exist or was deleted.
+func (r *PostRepo) ToggleLike(ctx context.Context, userID, postID string) (bool, int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Two toggles racing on one snapshot could both miss the like and the
+	// loser would report liked=false while the row exists. Locking the post
+	// row first makes the statement below see the winner's like.
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM posts WHERE id = $1::uuid FOR UPDATE`, postID); err != nil {
+		return false, 0, err
+	}
+
+	var liked bool
+	var count int
+	err = tx.QueryRow(ctx, `
+		WITH post AS (
+			SELECT id FROM posts WHERE id = $2::uuid AND deleted_at IS NULL
+		), del AS (
+			DELETE FROM likes
+			WHERE user_id = $1::uuid AND post_id IN (SELECT id FROM post)
+			RETURNING post_id
+		), ins AS (
+			INSERT INTO likes (user_id, post_id)
+			SELECT $1::uuid, id FROM post
+			WHERE NOT EXISTS (SELECT 1 FROM del)
+			ON CONFLICT DO NOTHING
+			RETURNING post_id
+		)
+		UPDATE posts
+		SET likes_count = likes_count + (SELECT COUNT(*) FROM ins) - (SELECT COUNT(*) FROM del)
+		WHERE id IN (SELECT id FROM post)
+		RETURNING EXISTS (SELECT 1 FROM ins), likes_count
+	`, userID, postID).Scan(&liked, &count)
+	if err != nil {
+		return false, 0, err
+	}
+	return liked, count, tx.Commit(ctx)
+}
+
+// SetLike likes or unlikes the post. Repeating a call changes nothing, so
+// clients can retry it safely. It returns the new count, or pgx.ErrNoRows
+// if the post doesn't exist or was deleted.
+func (r *PostRepo) SetLike(ctx context.Context, userID, postID string, liked bool) (int, error) {
+	change := `
+		INSERT INTO likes (user_id, post_id)
+		SELECT $1::uuid, id FROM post
+		ON CONFLICT DO NOTHING
+		RETURNING post_id`
+	sign := "+"
+	if !liked {
+		change = `
+		DELETE FROM likes
+		WHERE user_id = $1::uuid AND post_id IN (SELECT id FROM post)
+		RETURNING post_id`
+		sign = "-"
+	}
+
+	var count int
 	err := r.db.QueryRow(ctx, `
-		INSERT INTO comments (user_id, post_id, content)
-		VALUES ($1::uuid, $2::uuid, $3)
+		WITH post AS (
+			SELECT id FROM posts WHERE id = $2::uuid AND deleted_at IS NULL
+		), changed AS (`+change+`
+		)
+		UPDATE posts
+		SET likes_count = likes_count `+sign+` (SELECT COUNT(*) FROM changed)
+		WHERE id IN (SELECT id FROM post)
+		RETURNING likes_count
+	`, userID, postID).Scan(&count)
+	return count, err
+}
+
+// AddComment stores the comment and bumps the post's comments_count. It
+// returns pgx.ErrNoRows if the post doesn't exist or was deleted.
+func (r *PostRepo) AddComment(ctx context.Context, c NewComment) (string, error) {
+	var parentID *string
+	if c.ParentID != "" {
+		parentID = &c.ParentID
+	}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locking the post row first serialises counter updates and keeps the
+	// post from being deleted underneath us.
+	var id string
+	err = tx.QueryRow(ctx, `
+		SELECT id::text FROM posts
+		WHERE id = $1::uuid AND deleted_at IS NULL
+		FOR UPDATE
+	`, c.PostID).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.QueryRow(ctx, `
+		INSERT INTO comments (user_id, post_id, parent_comment_id, depth, content)
+		VALUES ($1::uuid, $2::uuid, $3::uuid, $4, $5)
 		RETURNING id
-	`, userID, postID, content).Scan(&id)
-	return id, err
+	`, c.UserID, c.PostID, parentID, c.Depth, c.Content).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE posts SET comments_count = comments_count + 1 WHERE id = $1::uuid
+	`, c.PostID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := setMentions(ctx, tx, "comment_id", id, c.Content, ""); err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit(ctx)
 }
 
-func (r *PostRepo) GetComments(ctx context.Context, postID string) ([]Comment, error) {
-	rows, err := r.db.Query(ctx, `
-		SELECT 
+// commentSelect is shared by the queries that return comments. $1 is the
+// viewer, for is_liked_by_me; callers append WHERE/ORDER clauses.
+const commentSelect = `
+		SELECT
 			c.id::text,
 			c.post_id::text,
 			c.user_id::text,
+			COALESCE(c.parent_comment_id::text, ''),
+			c.depth,
 			c.content,
 			c.created_at,
+			c.edited_at,
+			c.deleted_at IS NOT NULL,
 			u.first_name,
-			u.last_name
+			u.last_name,
+			COALESCE(u.username, ''),
+			(SELECT COUNT(*) FROM comment_likes WHERE comment_id = c.id),
+			EXISTS(SELECT 1 FROM comment_likes WHERE comment_id = c.id AND user_id = $1::uuid),
+			(SELECT COUNT(*) FROM comments r WHERE r.parent_comment_id = c.id),
+			COALESCE((
+				SELECT json_agg(json_build_object(
+					'user_id', mn.user_id, 'handle', mn.handle,
+					'offset', mn.offset_utf16, 'length', mn.length_utf16
+				) ORDER BY mn.offset_utf16)
+				FROM mentions mn WHERE mn.comment_id = c.id
+			), '[]')
 		FROM comments c
 		JOIN users u ON c.user_id = u.id
-		WHERE c.post_id = $1::uuid
-		ORDER BY c.created_at ASC
-	`, postID)
+`
+
+func scanComment(row pgx.Row) (Comment, error) {
+	var c Comment
+	err := row.Scan(&c.ID, &c.PostID, &c.UserID, &c.ParentCommentID, &c.Depth, &c.Content,
+		&c.CreatedAt, &c.EditedAt, &c.IsDeleted, &c.AuthorFirstName, &c.AuthorLastName,
+		&c.AuthorUsername, &c.LikesCount, &c.IsLikedByMe, &c.ReplyCount, &c.Mentions)
+	c.IsEdited = c.EditedAt != nil
+	return c, err
+}
+
+func (r *PostRepo) queryComments(ctx context.Context, sql string, args ...any) ([]Comment, error) {
+	rows, err := r.db.Query(ctx, sql, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -153,12 +782,225 @@ func (r *PostRepo) GetComments(ctx context.Context, postID string) ([]Comment, e
 
 	var comments []Comment
 	for rows.Next() {
-		var c Comment
-		err := rows.Scan(&c.ID, &c.PostID, &c.UserID, &c.Content, &c.CreatedAt, &c.AuthorFirstName, &c.AuthorLastName)
+		c, err := scanComment(rows)
 		if err != nil {
 			return nil, err
 		}
 		comments = append(comments, c)
 	}
-	return comments, nil
+	return comments, rows.Err()
+}
+
+// GetComments returns a page of a post's top-level comments, oldest first.
+func (r *PostRepo) GetComments(ctx context.Context, postID, currentUserID string, limit, offset int) ([]Comment, error) {
+	return r.queryComments(ctx, commentSelect+`
+		WHERE c.post_id = $2::uuid AND c.parent_comment_id IS NULL
+		ORDER BY c.created_at ASC
+		LIMIT $3 OFFSET $4
+	`, currentUserID, postID, limit, offset)
+}
+
+// GetReplies returns a page of the direct replies to a comment, oldest first.
+func (r *PostRepo) GetReplies(ctx context.Context, parentID, currentUserID string, limit, offset int) ([]Comment, error) {
+	return r.queryComments(ctx, commentSelect+`
+		WHERE c.parent_comment_id = $2::uuid
+		ORDER BY c.created_at ASC
+		LIMIT $3 OFFSET $4
+	`, currentUserID, parentID, limit, offset)
+}
+
+func (r *PostRepo) GetComment(ctx context.Context, id, currentUserID string) (*Comment, error) {
+	c, err := scanComment(r.db.QueryRow(ctx, commentSelect+`
+		WHERE c.id = $2::uuid
+	`, currentUserID, id))
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// UpdateComment replaces the content and the mentions in it.
+func (r *PostRepo) UpdateComment(ctx context.Context, id, content string) (time.Time, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var editedAt time.Time
+	err = tx.QueryRow(ctx, `
+		UPDATE comments
+		SET content = $2, edited_at = NOW()
+		WHERE id = $1::uuid AND deleted_at IS NULL
+		RETURNING edited_at
+	`, id, content).Scan(&editedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := setMentions(ctx, tx, "comment_id", id, content, ""); err != nil {
+		return time.Time{}, err
+	}
+
+	return editedAt, tx.Commit(ctx)
+}
+
+// DeleteComment removes a comment and lowers the post's comments_count.
+// One that has replies is turned into a tombstone instead so the thread
+// below it survives.
+func (r *PostRepo) DeleteComment(ctx context.Context, id string) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the post row first, as AddComment does, so a reply can't be
+	// added between checking for replies and deleting the comment.
+	var postID string
+	err = tx.QueryRow(ctx, `
+		SELECT p.id::text FROM posts p
+		JOIN comments c ON c.post_id = p.id
+		WHERE c.id = $1::uuid
+		FOR UPDATE OF p
+	`, id).Scan(&postID)
+	if err != nil {
+		return err
+	}
+
+	var hasReplies bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM comments r WHERE r.parent_comment_id = c.id)
+		FROM comments c
+		WHERE id = $1::uuid AND deleted_at IS NULL
+		FOR UPDATE
+	`, id).Scan(&hasReplies)
+	if err != nil {
+		return err
+	}
+
+	if hasReplies {
+		_, err = tx.Exec(ctx, `
+			UPDATE comments SET content = '', deleted_at = NOW() WHERE id = $1::uuid
+		`, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM comment_likes WHERE comment_id = $1::uuid`, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM mentions WHERE comment_id = $1::uuid`, id)
+	} else {
+		_, err = tx.Exec(ctx, `DELETE FROM comments WHERE id = $1::uuid`, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE posts SET comments_count = comments_count - 1 WHERE id = $1::uuid
+	`, postID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ToggleCommentLike likes the comment if userID hasn't yet and unlikes it
+// otherwise. It returns the new state and like count, or
+// pgx.ErrNoRows if the comment doesn't exist or was deleted.
+func (r *PostRepo) ToggleCommentLike(ctx context.Context, userID, commentID string) (bool, int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// As in ToggleLike, the lock makes a concurrent toggle's like visible.
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM comments WHERE id = $1::uuid FOR UPDATE`, commentID); err != nil {
+		return false, 0, err
+	}
+
+	var liked bool
+	var count int
+	err = tx.QueryRow(ctx, `
+		WITH comment AS (
+			SELECT id FROM comments WHERE id = $2::uuid AND deleted_at IS NULL
+		), del AS (
+			DELETE FROM comment_likes
+			WHERE user_id = $1::uuid AND comment_id IN (SELECT id FROM comment)
+			RETURNING comment_id
+		), ins AS (
+			INSERT INTO comment_likes (user_id, comment_id)
+			SELECT $1::uuid, id FROM comment
+			WHERE NOT EXISTS (SELECT 1 FROM del)
+			ON CONFLICT DO NOTHING
+			RETURNING comment_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ins),
+			(SELECT COUNT(*) FROM comment_likes WHERE comment_id = comment.id)
+				+ (SELECT COUNT(*) FROM ins) - (SELECT COUNT(*) FROM del)
+		FROM comment
+	`, userID, commentID).Scan(&liked, &count)
+	if err != nil {
+		return false, 0, err
+	}
+	return liked, count, tx.Commit(ctx)
+}
+
+// SetCommentLike likes or unlikes the comment. Repeating a call changes
+// nothing, so clients can retry it safely. It returns the new like count, or
+// pgx.ErrNoRows if the comment doesn't exist or was deleted.
+func (r *PostRepo) SetCommentLike(ctx context.Context, userID, commentID string, liked bool) (int, error) {
+	change := `
+		INSERT INTO comment_likes (user_id, comment_id)
+		SELECT $1::uuid, id FROM comment
+		ON CONFLICT DO NOTHING
+		RETURNING comment_id`
+	sign := "+"
+	if !liked {
+		change = `
+		DELETE FROM comment_likes
+		WHERE user_id = $1::uuid AND comment_id IN (SELECT id FROM comment)
+		RETURNING comment_id`
+		sign = "-"
+	}
+
+	// The statement's snapshot doesn't see its own change, so it is added
+	// to the count by hand.
+	var count int
+	err := r.db.QueryRow(ctx, `
+		WITH comment AS (
+			SELECT id FROM comments WHERE id = $2::uuid AND deleted_at IS NULL
+		), changed AS (`+change+`
+		)
+		SELECT (SELECT COUNT(*) FROM comment_likes WHERE comment_id = comment.id)
+			`+sign+` (SELECT COUNT(*) FROM changed)
+		FROM comment
+	`, userID, commentID).Scan(&count)
+	return count, err
+}
+
+// RecountCounters recomputes likes_count and comments_count from the likes
+// and comments tables and returns how many posts had drifted.
+func (r *PostRepo) RecountCounters(ctx context.Context) (int64, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE posts p
+		SET likes_count = n.likes, comments_count = n.comments
+		FROM (
+			SELECT
+				p.id,
+				(SELECT COUNT(*) FROM likes WHERE post_id = p.id) as likes,
+				(SELECT COUNT(*) FROM comments WHERE post_id = p.id AND deleted_at IS NULL) as comments
+			FROM posts p
+		) n
+		WHERE p.id = n.id
+		  AND (p.likes_count <> n.likes OR p.comments_count <> n.comments)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
 }
@@ -0,0 +1,201 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Presence statuses. A user is online if any of their sockets is active,
+// away if all of them are idle and offline once the last one disconnects.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// presenceStatus combines the rows of presence_connections pc for one user.
+const presenceStatus = `
+	CASE WHEN COUNT(pc.id) = 0 THEN 'offline'
+	     WHEN bool_and(pc.away) THEN 'away'
+	     ELSE 'online' END`
+
+// PresenceChange is a user's status across all instances after one of
+// their connections changed.
+type PresenceChange struct {
+	UserID   string
+	Status   string
+	LastSeen time.Time
+	Changed  bool // Status differs from before the change
+}
+
+type Presence struct {
+	Status   string
+	LastSeen *time.Time
+}
+
+// PresenceRepo keeps the open chat sockets of every app instance.
+type PresenceRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPresenceRepo(db *pgxpool.Pool) *PresenceRepo {
+	return &PresenceRepo{db: db}
+}
+
+// Connect records a new socket of the user and returns its connection id.
+func (r *PresenceRepo) Connect(ctx context.Context, userID string) (string, PresenceChange, error) {
+	var connID string
+	change, err := r.change(ctx, userID, func(tx pgx.Tx) error {
+		return tx.QueryRow(ctx, `
+			INSERT INTO presence_connections (user_id) VALUES ($1::uuid) RETURNING id::text
+		`, userID).Scan(&connID)
+	})
+	return connID, change, err
+}
+
+// SetAway marks one of the user's sockets idle or active.
+func (r *PresenceRepo) SetAway(ctx context.Context, userID, connID string, away bool) (PresenceChange, error) {
+	return r.change(ctx, userID, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			UPDATE presence_connections SET away = $2, heartbeat_at = NOW() WHERE id = $1::uuid
+		`, connID, away)
+		return err
+	})
+}
+
+// Disconnect forgets one of the user's sockets.
+func (r *PresenceRepo) Disconnect(ctx context.Context, userID, connID string) (PresenceChange, error) {
+	return r.change(ctx, userID, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DELETE FROM presence_connections WHERE id = $1::uuid`, connID)
+		return err
+	})
+}
+
+// Heartbeat marks the connections as still open.
+func (r *PresenceRepo) Heartbeat(ctx context.Context, connIDs []string) error {
+	if len(connIDs) == 0 {
+		return nil
+	}
+	_, err := r.db.Exec(ctx, `
+		UPDATE presence_connections SET heartbeat_at = NOW() WHERE id = ANY($1::uuid[])
+	`, connIDs)
+	return err
+}
+
+// ExpireStale drops connections that haven't had a heartbeat for ttl,
+// typically because their instance died, and returns the changes of users
+// whose status changed as a result.
+func (r *PresenceRepo) ExpireStale(ctx context.Context, ttl time.Duration) ([]PresenceChange, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT user_id::text FROM presence_connections
+		WHERE heartbeat_at < NOW() - make_interval(secs => $1::float8)
+	`, ttl.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var changes []PresenceChange
+	for _, userID := range userIDs {
+		change, err := r.change(ctx, userID, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `
+				DELETE FROM presence_connections
+				WHERE user_id = $1::uuid AND heartbeat_at < NOW() - make_interval(secs => $2::float8)
+			`, userID, ttl.Seconds())
+			return err
+		})
+		if err != nil {
+			return changes, err
+		}
+		if change.Changed {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// GetPresence returns the status and last-seen time of each of the given users.
+func (r *PresenceRepo) GetPresence(ctx context.Context, userIDs []string) (map[string]Presence, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT u.id::text, `+presenceStatus+`, u.last_seen_at
+		FROM users u
+		LEFT JOIN presence_connections pc ON pc.user_id = u.id
+		WHERE u.id = ANY($1::uuid[])
+		GROUP BY u.id
+	`, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	presence := make(map[string]Presence)
+	for rows.Next() {
+		var id string
+		var p Presence
+		if err := rows.Scan(&id, &p.Status, &p.LastSeen); err != nil {
+			return nil, err
+		}
+		presence[id] = p
+	}
+	return presence, rows.Err()
+}
+
+// change applies fn with the user's row locked, so connection changes from
+// every instance are applied one at a time, and compares the user's status
+// before and after. It also stamps last_seen_at.
+func (r *PresenceRepo) change(ctx context.Context, userID string, fn func(pgx.Tx) error) (PresenceChange, error) {
+	c := PresenceChange{UserID: userID}
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT 1 FROM users WHERE id = $1::uuid FOR UPDATE`, userID); err != nil {
+		return c, err
+	}
+
+	var before string
+	if err := userPresence(ctx, tx, userID).Scan(&before); err != nil {
+		return c, err
+	}
+	if err := fn(tx); err != nil {
+		return c, err
+	}
+	if err := userPresence(ctx, tx, userID).Scan(&c.Status); err != nil {
+		return c, err
+	}
+	c.Changed = c.Status != before
+
+	err = tx.QueryRow(ctx, `
+		UPDATE users SET last_seen_at = NOW() WHERE id = $1::uuid RETURNING last_seen_at
+	`, userID).Scan(&c.LastSeen)
+	if err != nil {
+		return c, err
+	}
+
+	return c, tx.Commit(ctx)
+}
+
+func userPresence(ctx context.Context, tx pgx.Tx, userID string) pgx.Row {
+	return tx.QueryRow(ctx, `
+		SELECT`+presenceStatus+` FROM presence_connections pc WHERE pc.user_id = $1::uuid
+	`, userID)
+}
@@ -2,19 +2,50 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	ErrUsernameTaken    = errors.New("username is taken")
+	ErrUsernameCooldown = errors.New("username was changed too recently")
+)
+
+// User is an account. Email is only shown to the user themselves; everyone
+// else knows them by Username, which is empty until they pick one.
 type User struct {
-	ID           string `json:"id"`
-	Email        string `json:"email"`
-	PasswordHash string
-	Role         string `json:"role"`
-	FirstName    string `json:"first_name"`
-	LastName     string `json:"last_name"`
-	Bio          string `json:"bio"`
-	AvatarURL    string `json:"avatar_url"`
+	ID                string     `json:"id"`
+	Email             string     `json:"email,omitempty"`
+	Username          string     `json:"username"`
+	UsernameChangedAt *time.Time `json:"username_changed_at,omitempty"`
+	PasswordHash      string     `json:"-"`
+	Role              string     `json:"role"`
+	FirstName         string     `json:"first_name"`
+	LastName          string     `json:"last_name"`
+	Bio               string     `json:"bio"`
+	AvatarURL         string     `json:"avatar_url"`
+}
+
+// Roles a user can pick at signup.
+const (
+	UserRoleStudent = "student"
+	UserRoleTeacher = "teacher"
+)
+
+// Site-wide roles that may moderate other users' posts. They are only
+// assigned directly in the database.
+const (
+	UserRoleAdmin     = "admin"
+	UserRoleModerator = "moderator"
+)
+
+func (u *User) IsModerator() bool {
+	return u.Role == UserRoleAdmin || u.Role == UserRoleModerator
 }
 
 type UserRepo struct {
@@ -25,14 +56,45 @@ func NewUserRepo(db *pgxpool.Pool) *UserRepo {
 	return &UserRepo{db: db}
 }
 
-func (r *UserRepo) Create(ctx context.Context, email, passwordHash, role, firstName, lastName, bio string) (string, error) {
+// Create stores a new user. username is optional; it returns
+// ErrUsernameTaken if someone has it or is still redirected from it.
+func (r *UserRepo) Create(ctx context.Context, email, passwordHash, role, firstName, lastName, bio, username string) (string, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if username != "" {
+		if err := lockUsernames(ctx, tx, username); err != nil {
+			return "", err
+		}
+		var redirected bool
+		err = tx.QueryRow(ctx, `
+			SELECT EXISTS(SELECT 1 FROM username_redirects WHERE username = LOWER($1) AND expires_at > NOW())
+		`, username).Scan(&redirected)
+		if err != nil {
+			return "", err
+		}
+		if redirected {
+			return "", ErrUsernameTaken
+		}
+	}
+
 	var id string
-	err := r.db.QueryRow(ctx, `
-        INSERT INTO users (email, password_hash, role, first_name, last_name, bio)
-        VALUES ($1, $2, $3, $4, $5, NULLIF($6,''))
+	err = tx.QueryRow(ctx, `
+        INSERT INTO users (email, password_hash, role, first_name, last_name, bio, username, username_changed_at)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6,''), NULLIF($7,''), CASE WHEN $7 <> '' THEN NOW() END)
         RETURNING id
-    `, email, passwordHash, role, firstName, lastName, bio).Scan(&id)
-	return id, err
+    `, email, passwordHash, role, firstName, lastName, bio, username).Scan(&id)
+	if isUniqueViolation(err, "idx_users_username") {
+		return "", ErrUsernameTaken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return id, tx.Commit(ctx)
 }
 
 func (r *UserRepo) GetByEmail(ctx context.Context, email string) (*User, error) {
@@ -60,6 +122,8 @@ func (r *UserRepo) GetByID(ctx context.Context, id string) (*User, error) {
 		SELECT
 		  id::text,
 		  email,
+		  COALESCE(username, ''),
+		  username_changed_at,
 		  password_hash,
 		  role,
 		  COALESCE(first_name, ''),
@@ -71,6 +135,8 @@ func (r *UserRepo) GetByID(ctx context.Context, id string) (*User, error) {
 	`, id).Scan(
 		&u.ID,
 		&u.Email,
+		&u.Username,
+		&u.UsernameChangedAt,
 		&u.PasswordHash,
 		&u.Role,
 		&u.FirstName,
@@ -83,3 +149,142 @@ func (r *UserRepo) GetByID(ctx context.Context, id string) (*User, error) {
 	}
 	return u, nil
 }
+
+// GetIDByUsername finds the user a handle belongs to, case-insensitively.
+// A handle its owner gave up less than the redirect period ago still finds
+// them; current is then their new username. It returns pgx.ErrNoRows if
+// nobody has the handle.
+func (r *UserRepo) GetIDByUsername(ctx context.Context, username string) (id, current string, err error) {
+	// A live username wins over a redirect left behind on the same handle.
+	err = r.db.QueryRow(ctx, `
+		SELECT id, username FROM (
+			SELECT id::text, username, 0 AS priority FROM users WHERE LOWER(username) = LOWER($1)
+			UNION ALL
+			SELECT u.id::text, u.username, 1
+			FROM username_redirects rd
+			JOIN users u ON u.id = rd.user_id
+			WHERE rd.username = LOWER($1) AND rd.expires_at > NOW()
+		) h
+		ORDER BY priority
+		LIMIT 1
+	`, username).Scan(&id, &current)
+	return id, current, err
+}
+
+// IsUsernameTaken reports whether another user has the username or is
+// still redirected from it.
+func (r *UserRepo) IsUsernameTaken(ctx context.Context, username, exceptUserID string) (bool, error) {
+	var taken bool
+	err := r.db.QueryRow(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM users
+			       WHERE LOWER(username) = LOWER($1) AND id::text <> $2)
+			OR EXISTS(SELECT 1 FROM username_redirects
+			          WHERE username = LOWER($1) AND expires_at > NOW() AND user_id::text <> $2)
+	`, username, exceptUserID).Scan(&taken)
+	return taken, err
+}
+
+// SetUsername gives the user a new username. A user who already has one
+// can only change it once per cooldown; changing only its case is always
+// allowed. The old handle keeps pointing at the user for redirectFor, and
+// nobody else can take it in the meantime. It returns ErrUsernameTaken or
+// ErrUsernameCooldown if the change isn't allowed.
+func (r *UserRepo) SetUsername(ctx context.Context, userID, username string, cooldown, redirectFor time.Duration) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var old *string
+	var changedAt *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT username, username_changed_at FROM users WHERE id = $1::uuid FOR UPDATE
+	`, userID).Scan(&old, &changedAt)
+	if err != nil {
+		return err
+	}
+
+	renamed := old == nil || !strings.EqualFold(*old, username)
+	if !renamed {
+		_, err = tx.Exec(ctx, `UPDATE users SET username = $2 WHERE id = $1::uuid`, userID, username)
+		if err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+	if old != nil && changedAt != nil && time.Since(*changedAt) < cooldown {
+		return ErrUsernameCooldown
+	}
+
+	// The new handle is checked against redirects and the old one becomes
+	// one, so both are held until commit.
+	handles := []string{username}
+	if old != nil {
+		handles = append(handles, *old)
+	}
+	if err := lockUsernames(ctx, tx, handles...); err != nil {
+		return err
+	}
+
+	var taken bool
+	err = tx.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM username_redirects
+		              WHERE username = LOWER($1) AND expires_at > NOW() AND user_id <> $2::uuid)
+	`, username, userID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrUsernameTaken
+	}
+
+	// Taking back one of the user's own old handles ends its redirect.
+	_, err = tx.Exec(ctx, `DELETE FROM username_redirects WHERE username = LOWER($1)`, username)
+	if err != nil {
+		return err
+	}
+
+	if old != nil {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO username_redirects (username, user_id, expires_at)
+			VALUES (LOWER($1), $2::uuid, NOW() + make_interval(secs => $3::float8))
+			ON CONFLICT (username) DO UPDATE
+			SET user_id = EXCLUDED.user_id, expires_at = EXCLUDED.expires_at, created_at = NOW()
+		`, *old, userID, redirectFor.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE users SET username = $2, username_changed_at = NOW() WHERE id = $1::uuid
+	`, userID, username)
+	if isUniqueViolation(err, "idx_users_username") {
+		return ErrUsernameTaken
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// lockUsernames takes transaction-level advisory locks on the handles, so
+// checking a handle against username_redirects and then claiming it can't
+// interleave with another signup or rename involving the same handle.
+// Locks are taken in a fixed order to avoid deadlocks.
+func lockUsernames(ctx context.Context, tx pgx.Tx, handles ...string) error {
+	_, err := tx.Exec(ctx, `
+		SELECT pg_advisory_xact_lock(hashtext('username:' || h))
+		FROM (SELECT DISTINCT LOWER(h) AS h FROM unnest($1::text[]) AS t(h) ORDER BY 1) l
+	`, handles)
+	return err
+}
+
+// isUniqueViolation reports whether err is a unique violation of the named constraint or index.
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
@@ -0,0 +1,11 @@
+package repo
+
+import "regexp"
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsUUID reports whether s can be cast to uuid, so callers can reject bad
+// input with a 400 instead of a database error.
+func IsUUID(s string) bool {
+	return uuidRegex.MatchString(s)
+}
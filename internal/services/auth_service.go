@@ -17,6 +17,7 @@ var (
 	ErrEmailTaken      = errors.New("email already registered")
 	ErrBadCredentials  = errors.New("wrong email or password")
 	ErrWeakPassword    = errors.New("password too short")
+	ErrBadRole         = errors.New("role must be student or teacher")
 	aituEmailRegex     = regexp.MustCompile(`^\d{4,12}@astanait\.edu\.kz$`)
 	defaultSessionLife = 7 * 24 * time.Hour
 )
@@ -30,7 +31,8 @@ func NewAuthService(users *repo.UserRepo, sessions *repo.SessionRepo) *AuthServi
 	return &AuthService{users: users, sessions: sessions}
 }
 
-func (s *AuthService) SignUp(ctx context.Context, email, password, role, firstName, lastName, bio string) (string, error) {
+// SignUp creates an account. username is optional; it can be picked later.
+func (s *AuthService) SignUp(ctx context.Context, email, password, role, firstName, lastName, bio, username string) (string, error) {
 	if !aituEmailRegex.MatchString(email) {
 		return "", ErrInvalidEmail
 	}
@@ -41,7 +43,16 @@ func (s *AuthService) SignUp(ctx context.Context, email, password, role, firstNa
 		return "", ErrBadName
 	}
 	if role == "" {
-		role = "student"
+		role = repo.UserRoleStudent
+	}
+	// Moderator and admin roles are granted out of band, never at signup.
+	if role != repo.UserRoleStudent && role != repo.UserRoleTeacher {
+		return "", ErrBadRole
+	}
+	if username != "" {
+		if err := ValidateUsername(username); err != nil {
+			return "", err
+		}
 	}
 
 	exists, err := s.users.ExistsByEmail(ctx, email)
@@ -52,12 +63,22 @@ func (s *AuthService) SignUp(ctx context.Context, email, password, role, firstNa
 		return "", ErrEmailTaken
 	}
 
+	if username != "" {
+		taken, err := s.users.IsUsernameTaken(ctx, username, "")
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "", repo.ErrUsernameTaken
+		}
+	}
+
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return "", err
 	}
 
-	return s.users.Create(ctx, email, string(hashBytes), role, firstName, lastName, bio)
+	return s.users.Create(ctx, email, string(hashBytes), role, firstName, lastName, bio, username)
 }
 
 func (s *AuthService) SignIn(ctx context.Context, email, password string) (sessionID string, err error) {
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+
+	"aitu-connect/internal/broker"
+	"aitu-connect/internal/repo"
+)
+
+var (
+	ErrEmptyMessage       = errors.New("conversation_id and content are required")
+	ErrClientMsgIDTooLong = errors.New("client_msg_id is too long")
+	ErrNotParticipant     = errors.New("not a participant")
+	ErrBadReply           = errors.New("reply_to_message_id must be a message in the same conversation")
+)
+
+const maxClientMsgIDLen = 64
+
+// Broker topics. Every instance receives every topic and delivers it to the
+// connections it holds locally.
+const (
+	TopicConversation = "conv:" // payload is a client event for conversation members
+	TopicUser         = "user:" // payload is a client event for one user
+	TopicSubscribe    = "sub:"  // payload is a conversation ID the user's connections should follow
+)
+
+// MessageEvent is the "message" event clients receive for a new message.
+type MessageEvent struct {
+	Type string `json:"type"`
+	repo.Message
+}
+
+func NewMessageEvent(m repo.Message) MessageEvent {
+	return MessageEvent{Type: "message", Message: m}
+}
+
+// ChatService is the write side of chat shared by every transport: sends
+// over the WebSocket and over HTTP both end up here, and every event for
+// connected clients is published through it.
+type ChatService struct {
+	chats  *repo.ChatRepo
+	users  *repo.UserRepo
+	broker broker.Broker
+}
+
+func NewChatService(chats *repo.ChatRepo, users *repo.UserRepo, b broker.Broker) *ChatService {
+	return &ChatService{chats: chats, users: users, broker: b}
+}
+
+type SendMessageInput struct {
+	ConversationID   string
+	Content          string
+	ReplyToMessageID string   // optional
+	AttachmentIDs    []string // optional
+	ClientMsgID      string   // optional
+}
+
+// SendMessage validates, stores and broadcasts a message and returns it as
+// stored. A retry with the same ClientMsgID returns the original message
+// with duplicate set, and is not broadcast again.
+func (s *ChatService) SendMessage(ctx context.Context, userID string, in SendMessageInput) (*repo.Message, bool, error) {
+	if in.ConversationID == "" || (in.Content == "" && len(in.AttachmentIDs) == 0) {
+		return nil, false, ErrEmptyMessage
+	}
+	if len(in.ClientMsgID) > maxClientMsgIDLen {
+		return nil, false, ErrClientMsgIDTooLong
+	}
+	ok, err := s.chats.IsParticipant(ctx, in.ConversationID, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrNotParticipant
+	}
+
+	if in.ReplyToMessageID != "" {
+		if !repo.IsUUID(in.ReplyToMessageID) {
+			return nil, false, ErrBadReply
+		}
+		parent, err := s.chats.GetMessage(ctx, in.ReplyToMessageID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && parent.ConversationID != in.ConversationID) {
+			return nil, false, ErrBadReply
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	saved, err := s.chats.SaveMessage(ctx, repo.NewMessage{
+		ConversationID: in.ConversationID,
+		UserID:         userID,
+		Content:        in.Content,
+		ReplyToID:      in.ReplyToMessageID,
+		ClientMsgID:    in.ClientMsgID,
+		AttachmentIDs:  in.AttachmentIDs,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	m, err := s.chats.GetMessageFor(ctx, saved.ID, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if saved.Duplicate {
+		return m, true, nil
+	}
+
+	s.BroadcastToConversation(m.ConversationID, NewMessageEvent(*m))
+	s.notifyParticipants(ctx, m)
+	s.NotifyMentioned(ctx, nil, m.Mentions, MessageMentionEvent(m))
+	return m, false, nil
+}
+
+// notifyParticipants sends a notification event to every participant who
+// hasn't muted the conversation. Clients use it for badges, sounds and
+// desktop notifications; the message itself arrives as a separate event.
+func (s *ChatService) notifyParticipants(ctx context.Context, m *repo.Message) {
+	recipients, err := s.chats.GetNotifiableUserIDs(ctx, m.ConversationID, m.UserID)
+	if err != nil {
+		log.Println("Error loading notification recipients:", err)
+		return
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	s.SendToUsers(recipients, map[string]interface{}{
+		"type":              "notification",
+		"conversation_id":   m.ConversationID,
+		"message_id":        m.ID,
+		"author_first_name": m.AuthorFirstName,
+		"author_last_name":  m.AuthorLastName,
+		"preview":           repo.QuoteSnippet(m.Content),
+	})
+}
+
+// MentionEvent is the "mention" event a user receives when someone names
+// them. PostID is set for posts and, with CommentID, for comments;
+// ConversationID and MessageID are set for chat messages.
+type MentionEvent struct {
+	Type            string `json:"type"`
+	AuthorID        string `json:"author_id"`
+	AuthorFirstName string `json:"author_first_name"`
+	AuthorLastName  string `json:"author_last_name"`
+	AuthorUsername  string `json:"author_username"`
+	PostID          string `json:"post_id,omitempty"`
+	CommentID       string `json:"comment_id,omitempty"`
+	ConversationID  string `json:"conversation_id,omitempty"`
+	MessageID       string `json:"message_id,omitempty"`
+	Preview         string `json:"preview"`
+}
+
+func PostMentionEvent(p *repo.Post) MentionEvent {
+	return MentionEvent{
+		AuthorID:        p.UserID,
+		AuthorFirstName: p.AuthorFirstName,
+		AuthorLastName:  p.AuthorLastName,
+		AuthorUsername:  p.AuthorUsername,
+		PostID:          p.ID,
+		Preview:         repo.QuoteSnippet(p.Content),
+	}
+}
+
+func CommentMentionEvent(c *repo.Comment) MentionEvent {
+	return MentionEvent{
+		AuthorID:        c.UserID,
+		AuthorFirstName: c.AuthorFirstName,
+		AuthorLastName:  c.AuthorLastName,
+		AuthorUsername:  c.AuthorUsername,
+		PostID:          c.PostID,
+		CommentID:       c.ID,
+		Preview:         repo.QuoteSnippet(c.Content),
+	}
+}
+
+func MessageMentionEvent(m *repo.Message) MentionEvent {
+	return MentionEvent{
+		AuthorID:        m.UserID,
+		AuthorFirstName: m.AuthorFirstName,
+		AuthorLastName:  m.AuthorLastName,
+		AuthorUsername:  m.AuthorUsername,
+		ConversationID:  m.ConversationID,
+		MessageID:       m.ID,
+		Preview:         repo.QuoteSnippet(m.Content),
+	}
+}
+
+// NotifyMentioned sends the event to users mentioned in after but not in
+// before, so an edit only notifies people it adds. The author is never
+// notified. Mentions in a chat only resolve to its participants, so nobody
+// hears about a conversation they aren't in, and participants who muted the
+// conversation aren't notified either.
+func (s *ChatService) NotifyMentioned(ctx context.Context, before, after []repo.Mention, event MentionEvent) {
+	seen := map[string]bool{event.AuthorID: true}
+	for _, m := range before {
+		seen[m.UserID] = true
+	}
+
+	var userIDs []string
+	for _, m := range after {
+		if !seen[m.UserID] {
+			seen[m.UserID] = true
+			userIDs = append(userIDs, m.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return
+	}
+
+	if event.ConversationID != "" {
+		notifiable, err := s.chats.GetNotifiableUserIDs(ctx, event.ConversationID, event.AuthorID)
+		if err != nil {
+			log.Println("Error loading mention recipients:", err)
+			return
+		}
+		unmuted := make(map[string]bool, len(notifiable))
+		for _, id := range notifiable {
+			unmuted[id] = true
+		}
+		userIDs = slices.DeleteFunc(userIDs, func(id string) bool { return !unmuted[id] })
+		if len(userIDs) == 0 {
+			return
+		}
+	}
+
+	event.Type = "mention"
+	s.SendToUsers(userIDs, event)
+}
+
+// BroadcastToConversation publishes an event to everyone subscribed to the
+// conversation, on this instance and on any other.
+func (s *ChatService) BroadcastToConversation(convID string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error encoding broadcast:", err)
+		return
+	}
+
+	s.publish(TopicConversation+convID, payload)
+}
+
+// SendToUsers publishes an event to every open connection of the given users.
+func (s *ChatService) SendToUsers(userIDs []string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error encoding event:", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		s.publish(TopicUser+userID, payload)
+	}
+}
+
+// SubscribeUser subscribes every open connection of the user, on any instance, to the conversation.
+func (s *ChatService) SubscribeUser(convID, userID string) {
+	s.publish(TopicSubscribe+userID, []byte(convID))
+}
+
+// Subscribe registers the handler that delivers published events to local connections.
+func (s *ChatService) Subscribe(h broker.Handler) {
+	s.broker.Subscribe(h)
+}
+
+func (s *ChatService) publish(topic string, payload []byte) {
+	if err := s.broker.Publish(context.Background(), topic, payload); err != nil {
+		log.Println("Error publishing chat event:", err)
+	}
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"aitu-connect/internal/repo"
+)
+
+// RankerConfig tunes the popular feed. Comments usually say more about a
+// post than a like, so they weigh more by default.
+type RankerConfig struct {
+	LikeWeight    float64
+	CommentWeight float64
+	// Age at which a post's engagement counts half as much.
+	HalfLife time.Duration
+	// How often scores are refreshed; new posts show up after the next refresh.
+	Interval time.Duration
+}
+
+var DefaultRankerConfig = RankerConfig{
+	LikeWeight:    1,
+	CommentWeight: 2,
+	HalfLife:      24 * time.Hour,
+	Interval:      time.Minute,
+}
+
+// FeedRanker keeps post_scores up to date for the popular feed, so feed
+// requests only read a precomputed index.
+type FeedRanker struct {
+	posts *repo.PostRepo
+	cfg   RankerConfig
+}
+
+func NewFeedRanker(posts *repo.PostRepo, cfg RankerConfig) *FeedRanker {
+	return &FeedRanker{posts: posts, cfg: cfg}
+}
+
+// Run refreshes scores right away and then every Interval until ctx is cancelled.
+func (f *FeedRanker) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+
+	weights := repo.ScoreWeights{
+		Like:     f.cfg.LikeWeight,
+		Comment:  f.cfg.CommentWeight,
+		HalfLife: f.cfg.HalfLife,
+	}
+	for {
+		if _, err := f.posts.RefreshScores(ctx, weights); err != nil && ctx.Err() == nil {
+			log.Println("Feed ranker error:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"aitu-connect/internal/imaging"
+	"aitu-connect/internal/repo"
+	"aitu-connect/internal/storage"
+)
+
+var (
+	// Longest side of each generated thumbnail, in pixels.
+	ThumbnailSizes = []int{160, 480, 1080}
+
+	imagePollInterval = 5 * time.Second
+	imageMaxAttempts  = 3
+)
+
+// ImageWorker processes uploaded images in the background: it strips
+// metadata from the original, stores thumbnails and records dimensions and
+// a blurhash. Jobs live in the attachments table, so any instance can pick them up.
+type ImageWorker struct {
+	attachments *repo.AttachmentRepo
+	store       storage.Storage
+	wake        chan struct{}
+}
+
+func NewImageWorker(attachments *repo.AttachmentRepo, store storage.Storage) *ImageWorker {
+	return &ImageWorker{
+		attachments: attachments,
+		store:       store,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Kick tells the worker a new job is waiting so it doesn't sit out the poll interval.
+func (w *ImageWorker) Kick() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes jobs until ctx is cancelled.
+func (w *ImageWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(imagePollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			worked, err := w.processNext(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Println("Image worker error:", err)
+			}
+			if !worked {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// processNext handles one job and reports whether there was one.
+func (w *ImageWorker) processNext(ctx context.Context) (bool, error) {
+	a, err := w.attachments.ClaimImageJob(ctx)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := w.process(ctx, a); err != nil {
+		if failErr := w.attachments.FailImageJob(ctx, a.ID, err.Error(), imageMaxAttempts); failErr != nil {
+			return true, failErr
+		}
+		return true, fmt.Errorf("attachment %s: %w", a.ID, err)
+	}
+	return true, nil
+}
+
+func (w *ImageWorker) process(ctx context.Context, a *repo.Attachment) error {
+	if err := w.convert(ctx, a); err != nil {
+		return err
+	}
+	return w.attachments.CompleteImageJob(ctx, a)
+}
+
+// convert replaces the stored original with a clean copy, stores its
+// thumbnails and fills in a's image fields.
+func (w *ImageWorker) convert(ctx context.Context, a *repo.Attachment) error {
+	body, err := w.store.Get(ctx, a.StorageKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	res, err := imaging.Process(data, ThumbnailSizes)
+	if err != nil {
+		return err
+	}
+
+	a.Thumbnails = nil
+	for _, t := range res.Thumbnails {
+		key := fmt.Sprintf("%s_%d", a.StorageKey, t.Size)
+		if err := w.store.Put(ctx, key, bytes.NewReader(t.Data), int64(len(t.Data)), t.ContentType); err != nil {
+			return err
+		}
+		a.Thumbnails = append(a.Thumbnails, repo.Thumbnail{
+			Size:        t.Size,
+			StorageKey:  key,
+			ContentType: t.ContentType,
+			SizeBytes:   int64(len(t.Data)),
+			Width:       t.Width,
+			Height:      t.Height,
+		})
+	}
+
+	// Replace the original last, once everything derived from it is stored.
+	if err := w.store.Put(ctx, a.StorageKey, bytes.NewReader(res.Original), int64(len(res.Original)), res.ContentType); err != nil {
+		return err
+	}
+
+	if res.ContentType != a.ContentType {
+		a.Filename = renameForType(a.Filename, res.ContentType)
+	}
+	a.ContentType = res.ContentType
+	a.SizeBytes = int64(len(res.Original))
+	a.Width = res.Width
+	a.Height = res.Height
+	a.Blurhash = res.Blurhash
+	return nil
+}
+
+// imageExtensions are the extensions of the types imaging.Process writes.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// renameForType swaps the extension of filename for one matching contentType,
+// e.g. when an opaque PNG was re-encoded as JPEG.
+func renameForType(filename, contentType string) string {
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ext
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"aitu-connect/internal/repo"
+)
+
+// memStore is an in-memory storage.Storage.
+type memStore struct {
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte), types: make(map[string]string)}
+}
+
+func (s *memStore) Put(_ context.Context, key string, r io.Reader, _ int64, contentType string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = data
+	s.types[key] = contentType
+	return nil
+}
+
+func (s *memStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memStore) Delete(_ context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func TestImageWorkerConvert(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 600, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 600; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newMemStore()
+	store.objects["u/photo"] = buf.Bytes()
+	w := &ImageWorker{store: store}
+
+	a := &repo.Attachment{StorageKey: "u/photo", Filename: "photo.png", ContentType: "image/png"}
+	if err := w.convert(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+
+	// The opaque PNG is stored as a JPEG under the same key and renamed.
+	if a.ContentType != "image/jpeg" || store.types["u/photo"] != "image/jpeg" {
+		t.Errorf("content type = %q, stored as %q, want image/jpeg", a.ContentType, store.types["u/photo"])
+	}
+	if a.Filename != "photo.jpg" {
+		t.Errorf("Filename = %q, want photo.jpg", a.Filename)
+	}
+	if a.SizeBytes != int64(len(store.objects["u/photo"])) {
+		t.Errorf("SizeBytes = %d, stored %d bytes", a.SizeBytes, len(store.objects["u/photo"]))
+	}
+	if a.Width != 600 || a.Height != 400 || a.Blurhash == "" {
+		t.Errorf("got %dx%d, blurhash %q", a.Width, a.Height, a.Blurhash)
+	}
+
+	// Only the sizes below the image's own are generated.
+	want := []struct {
+		key           string
+		width, height int
+	}{
+		{"u/photo_160", 160, 106},
+		{"u/photo_480", 480, 320},
+	}
+	if len(a.Thumbnails) != len(want) {
+		t.Fatalf("got %d thumbnails, want %d", len(a.Thumbnails), len(want))
+	}
+	for i, th := range a.Thumbnails {
+		if th.StorageKey != want[i].key || th.Width != want[i].width || th.Height != want[i].height {
+			t.Errorf("thumbnail %d = %s %dx%d, want %s %dx%d",
+				i, th.StorageKey, th.Width, th.Height, want[i].key, want[i].width, want[i].height)
+		}
+		data, ok := store.objects[th.StorageKey]
+		if !ok {
+			t.Errorf("thumbnail %s was not stored", th.StorageKey)
+			continue
+		}
+		if th.SizeBytes != int64(len(data)) || store.types[th.StorageKey] != th.ContentType {
+			t.Errorf("thumbnail %s: recorded %d bytes %s, stored %d bytes %s",
+				th.StorageKey, th.SizeBytes, th.ContentType, len(data), store.types[th.StorageKey])
+		}
+	}
+}
+
+func TestImageWorkerConvertKeepsOriginalOnError(t *testing.T) {
+	store := newMemStore()
+	store.objects["u/broken"] = []byte("not an image")
+	w := &ImageWorker{store: store}
+
+	a := &repo.Attachment{StorageKey: "u/broken", Filename: "broken.jpg", ContentType: "image/jpeg"}
+	if err := w.convert(context.Background(), a); err == nil {
+		t.Fatal("convert succeeded on a broken image")
+	}
+	if string(store.objects["u/broken"]) != "not an image" || len(store.objects) != 1 {
+		t.Error("convert changed the store after failing")
+	}
+}
+
+func TestRenameForType(t *testing.T) {
+	tests := []struct {
+		filename, contentType, want string
+	}{
+		{"photo.png", "image/jpeg", "photo.jpg"},
+		{"photo.JPEG", "image/png", "photo.png"},
+		{"scan.final.webp", "image/jpeg", "scan.final.jpg"},
+		{"noext", "image/png", "noext.png"},
+		{"photo.png", "image/gif", "photo.png"},
+	}
+	for _, tt := range tests {
+		if got := renameForType(tt.filename, tt.contentType); got != tt.want {
+			t.Errorf("renameForType(%q, %q) = %q, want %q", tt.filename, tt.contentType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadUsername      = errors.New("username must be 3-32 letters, digits, '_' or '.', start with a letter and not end with '.' or contain '..'")
+	ErrReservedUsername = errors.New("username is reserved")
+	usernameRegex       = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.]{1,30}[A-Za-z0-9_]$`)
+)
+
+const (
+	// A user who has a username can change it this often.
+	UsernameChangeCooldown = 30 * 24 * time.Hour
+	// How long an old username keeps pointing at its owner after a change.
+	UsernameRedirectPeriod = 90 * 24 * time.Hour
+)
+
+// reservedUsernames can't be taken because they would impersonate staff or
+// the app, or collide with routes and group mentions.
+var reservedUsernames = map[string]struct{}{
+	"admin": {}, "administrator": {}, "moderator": {}, "mod": {}, "staff": {},
+	"support": {}, "help": {}, "system": {}, "root": {}, "official": {},
+	"aitu": {}, "astanait": {}, "aituconnect": {},
+	"api": {}, "me": {}, "settings": {}, "login": {}, "logout": {}, "signup": {},
+	"everyone": {}, "here": {}, "all": {}, "channel": {},
+	"null": {}, "undefined": {},
+}
+
+// ValidateUsername checks a username a user wants to take. Usernames fit
+// the @mention syntax, so every username can be mentioned.
+func ValidateUsername(username string) error {
+	if !usernameRegex.MatchString(username) || strings.Contains(username, "..") {
+		return ErrBadUsername
+	}
+	if _, ok := reservedUsernames[strings.ToLower(username)]; ok {
+		return ErrReservedUsername
+	}
+	return nil
+}
+
+// SetUsername sets or changes the user's username; see repo.UserRepo.SetUsername.
+func (s *AuthService) SetUsername(ctx context.Context, userID, username string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	return s.users.SetUsername(ctx, userID, username, UsernameChangeCooldown, UsernameRedirectPeriod)
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     error
+	}{
+		{"bob", nil},
+		{"Bob_Smith", nil},
+		{"a.b", nil},
+		{"bob_", nil},
+		{"j.doe.2024", nil},
+		{"a" + strings.Repeat("b", 31), nil},
+
+		{"", ErrBadUsername},
+		{"bo", ErrBadUsername},
+		{"a" + strings.Repeat("b", 32), ErrBadUsername},
+		{"1bob", ErrBadUsername},
+		{"_bob", ErrBadUsername},
+		{".bob", ErrBadUsername},
+		{"bob.", ErrBadUsername},
+		{"bo..b", ErrBadUsername},
+		{"a..", ErrBadUsername},
+		{"bo b", ErrBadUsername},
+		{"bob-s", ErrBadUsername},
+		{"bob@x", ErrBadUsername},
+		{"бob", ErrBadUsername},
+
+		{"admin", ErrReservedUsername},
+		{"Admin", ErrReservedUsername},
+		{"MODERATOR", ErrReservedUsername},
+		{"everyone", ErrReservedUsername},
+		{"api", ErrReservedUsername},
+		{"aitu", ErrReservedUsername},
+		{"admin1", nil},
+	}
+	for _, tt := range tests {
+		if got := ValidateUsername(tt.username); got != tt.want {
+			t.Errorf("ValidateUsername(%q) = %v, want %v", tt.username, got, tt.want)
+		}
+	}
+}